@@ -3,6 +3,7 @@ package auth
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/xml"
 	"errors"
@@ -20,6 +21,7 @@ import (
 	"sslcon/proto"
 	"sslcon/session"
 	"sslcon/utils"
+	"sslcon/utils/vpnc"
 )
 
 var (
@@ -28,6 +30,10 @@ var (
 	BufR         *bufio.Reader
 	reqHeaders   = make(map[string]string)
 	WebVpnCookie string
+	// authenticated init 请求已经完成认证，如仅使用证书
+	authenticated bool
+	// device 启动时读取的设备信息，只读，Prof 和 DiscoverGroups 的 Profile 都由它复制
+	device = Profile{Scheme: "https://"}
 )
 
 // Profile 模板变量字段必须导出，虽然全局，但每次连接都被重置
@@ -38,6 +44,16 @@ type Profile struct {
 	Group     string `json:"group"`
 	SecretKey string `json:"secret"`
 
+	ProfileName string         `json:"profile"` // 使用的连接配置，为空表示由参数指定
+	AuthMethod  string         `json:"auth_method"`
+	CertFile    string         `json:"cert_file"`
+	KeyFile     string         `json:"key_file"`
+	CAFile      string         `json:"ca_file"`
+	Pins        []string       `json:"pins"`
+	Overrides   base.Overrides `json:"overrides"`
+	TOTPSecret  string         `json:"-"` // 来自凭据库，两步登陆时发送动态口令
+	Passphrase  string         `json:"-"` // 打开凭据库使用的口令，修改密码后重新保存凭据
+
 	Initialized bool
 	AppVersion  string // for report to server in xml
 
@@ -54,6 +70,14 @@ type Profile struct {
 	DeviceType      string
 	PlatformVersion string
 	UniqueId        string
+
+	AuthFields []AuthField `json:"-"` // 不为空时代替用户名密码提交，如修改密码
+}
+
+// AuthField 值已经过 XML 转义
+type AuthField struct {
+	Name  string
+	Value string
 }
 
 const (
@@ -65,32 +89,58 @@ func init() {
 	reqHeaders["X-Transcend-Version"] = "1"
 	reqHeaders["X-Aggregate-Auth"] = "1"
 
-	Prof.Scheme = "https://"
-
 	host, _ := sysinfo.Host()
 	info := host.Info()
-	Prof.ComputerName = info.Hostname
-	Prof.UniqueId = info.UniqueID
+	device.ComputerName = info.Hostname
+	device.UniqueId = info.UniqueID
 
 	os := info.OS
-	Prof.DeviceType = os.Name
+	device.DeviceType = os.Name
 	if runtime.GOOS == "windows" {
-		Prof.PlatformVersion = os.Build
+		device.PlatformVersion = os.Build
 	} else {
-		Prof.PlatformVersion = strings.Split(os.Version, " ")[0]
+		device.PlatformVersion = strings.Split(os.Version, " ")[0]
 	}
 	// log.Printf("%+v %+v", info, os)
+	*Prof = device
+}
+
+// newProfile 只包含设备信息的 Profile
+func newProfile() *Profile {
+	p := device
+	return &p
+}
+
+// Apply 使用连接配置覆盖上次连接的参数，cp 为空配置时即清空
+func (p *Profile) Apply(cp *base.ConnProfile) {
+	p.ProfileName = cp.Name
+	p.Host = cp.Host
+	p.Username = cp.Username
+	p.Password = ""
+	p.Group = cp.Group
+	p.SecretKey = cp.SecretKey
+	p.AuthMethod = cp.AuthMethod
+	p.CertFile = cp.CertFile
+	p.KeyFile = cp.KeyFile
+	p.CAFile = cp.CAFile
+	p.Pins = cp.Pins
+	p.Overrides = cp.Overrides
+	p.TOTPSecret = ""
+	p.Passphrase = ""
+}
+
+// CredentialScope 本次连接实际使用的服务端，用于打开凭据库
+func (p *Profile) CredentialScope() *base.CredentialScope {
+	return &base.CredentialScope{Host: p.Host, CAFile: p.CAFile, Pins: p.Pins}
 }
 
 // InitAuth 确定用户组和服务端认证地址 AuthPath
-func InitAuth() error {
+func InitAuth(ctx context.Context) error {
 	WebVpnCookie = ""
-	// https://github.com/mwitkow/go-http-dialer
-	config := tls.Config{
-		InsecureSkipVerify: base.Cfg.InsecureSkipVerify,
-	}
+	authenticated = false
+	session.Sess.ResetBanners()
 	var err error
-	Conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 6 * time.Second}, "tcp4", Prof.HostWithPort, &config)
+	Conn, err = dial(ctx, Prof)
 	if err != nil {
 		return err
 	}
@@ -102,7 +152,7 @@ func InitAuth() error {
 	Prof.AppVersion = base.Cfg.AgentVersion
 	Prof.MacAddress = base.LocalInterface.Mac
 
-	err = tplPost(tplInit, "", dtd)
+	err = tplPost(ctx, Conn, BufR, Prof, tplInit, "", dtd)
 	if err != nil {
 		return err
 	}
@@ -114,26 +164,52 @@ func InitAuth() error {
 	Prof.GroupAlias = dtd.Opaque.GroupAlias
 	Prof.ConfigHash = dtd.Opaque.ConfigHash
 
-	gps := len(dtd.Auth.Form.Groups)
-	if gps != 0 && !utils.InArray(dtd.Auth.Form.Groups, Prof.Group) {
-		return fmt.Errorf("available user groups are: %s", strings.Join(dtd.Auth.Form.Groups, " "))
+	groups := dtd.Auth.Form.Groups()
+	if len(groups) != 0 {
+		// 用户组可以是选项的值或者显示的名称
+		group, ok := dtd.Auth.Form.Group(Prof.Group)
+		if !ok {
+			return base.Errorf(base.ErrGroupRequired, "available user groups are: %s", strings.Join(groups, " ")).
+				WithData(map[string]interface{}{"groups": dtd.Auth.Form.Options})
+		}
+		Prof.Group = group
 	}
 
+	// 登录前 banner 必须在发送用户名密码之前确认
+	session.Sess.PreLoginBanner = strings.TrimSpace(dtd.Auth.Banner)
+	err = session.Sess.AcceptBanner(ctx, session.BannerPreLogin, session.Sess.PreLoginBanner)
+	if err != nil {
+		return err
+	}
+	// 仅使用证书认证时服务端可能直接返回认证成功
+	if dtd.Type == "complete" {
+		complete(dtd)
+	}
 	return nil
 }
 
 // PasswordAuth 认证成功后，服务端新建 ConnSession，并生成 SessionToken 或者通过 Header 返回 WebVpnCookie
-func PasswordAuth() error {
+func PasswordAuth(ctx context.Context) error {
+	if authenticated {
+		return nil
+	}
+	Prof.AuthFields = nil
 	dtd := new(proto.DTD)
 	// 发送用户名或者用户名+密码
-	err := tplPost(tplAuthReply, Prof.AuthPath, dtd)
+	err := tplPost(ctx, Conn, BufR, Prof, tplAuthReply, Prof.AuthPath, dtd)
 	if err != nil {
 		return err
 	}
 	// 兼容两步登陆，如必要则再次发送
-	if dtd.Type == "auth-request" && dtd.Auth.Error.Value == "" {
-		dtd = new(proto.DTD)
-		err = tplPost(tplAuthReply, Prof.AuthPath, dtd)
+	if dtd.Type == "auth-request" && dtd.Auth.Error.Value == "" && !dtd.Auth.PasswordChange() {
+		err = secondFactor(ctx, dtd)
+		if err != nil {
+			return err
+		}
+	}
+	// 密码过期，修改成功后继续登录
+	if dtd.Type == "auth-request" && dtd.Auth.PasswordChange() {
+		dtd, err = changePassword(ctx, dtd)
 		if err != nil {
 			return err
 		}
@@ -141,11 +217,38 @@ func PasswordAuth() error {
 	// 用户名、密码等错误
 	if dtd.Type == "auth-request" {
 		if dtd.Auth.Error.Value != "" {
-			return fmt.Errorf(dtd.Auth.Error.Value, dtd.Auth.Error.Param1)
+			return base.Errorf(base.ErrAuthFailed, dtd.Auth.Error.Value, dtd.Auth.Error.Param1)
 		}
-		return errors.New(dtd.Auth.Message)
+		return base.NewError(base.ErrAuthFailed, errors.New(dtd.Auth.Message))
 	}
 
+	complete(dtd)
+	return nil
+}
+
+// secondFactor 两步登陆的第二步，凭据库中保存了 TOTP 种子时发送动态口令，否则重复发送密码
+func secondFactor(ctx context.Context, dtd *proto.DTD) error {
+	password := Prof.Password
+	if Prof.TOTPSecret != "" {
+		code, err := totp(Prof.TOTPSecret, time.Now())
+		if err != nil {
+			return err
+		}
+		Prof.Password = code
+		defer func() {
+			Prof.Password = password
+		}()
+	}
+	*dtd = proto.DTD{}
+	return tplPost(ctx, Conn, BufR, Prof, tplAuthReply, Prof.AuthPath, dtd)
+}
+
+// complete 保存认证成功后服务端返回的 SessionToken
+func complete(dtd *proto.DTD) {
+	authenticated = true
+	// AnyConnect 在认证成功的响应中下发登录后 banner，ocserv 通过 X-CSTP-Banner 下发
+	session.Sess.PostLoginBanner = strings.TrimSpace(dtd.Auth.Banner)
+
 	// AnyConnect 客户端支持 XML，OpenConnect 不使用 XML，而是使用 Cookie 反馈给客户端登陆状态
 	session.Sess.SessionToken = dtd.SessionToken
 	// 兼容 OpenConnect
@@ -153,18 +256,68 @@ func PasswordAuth() error {
 		session.Sess.SessionToken = WebVpnCookie
 	}
 	base.Debug("SessionToken:" + session.Sess.SessionToken)
+}
+
+// Redial 重连时原来的 TLS 连接已经关闭，使用新连接和之前认证得到的 SessionToken 建立隧道
+func Redial(ctx context.Context) error {
+	conn, err := dial(ctx, Prof)
+	if err != nil {
+		return err
+	}
+	Conn = conn
+	BufR = bufio.NewReader(Conn)
 	return nil
 }
 
-// 渲染模板并发送请求
-func tplPost(typ int, path string, dtd *proto.DTD) error {
+// dial 认证和建立隧道复用同一个 TLS 连接
+func dial(ctx context.Context, prof *Profile) (*tls.Conn, error) {
+	// https://github.com/mwitkow/go-http-dialer
+	config, err := tlsConfig(prof)
+	if err != nil {
+		return nil, err
+	}
+	addr := prof.HostWithPort
+	// 断网保护阻止了 DNS 查询，重连时使用保护生效时的服务器地址，证书仍然验证域名
+	host, port, _ := net.SplitHostPort(addr)
+	if ip, active := vpnc.KillSwitchServer(host); ip != "" {
+		config.ServerName = host
+		addr = net.JoinHostPort(ip, port)
+	} else if active {
+		return nil, base.Errorf(base.ErrConflict, "kill switch is active for another server, disconnect first")
+	}
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: time.Duration(base.Cfg.DialTimeout) * time.Second, Control: vpnc.MarkControl},
+		Config:    config,
+	}
+	c, err := dialer.DialContext(ctx, "tcp4", addr)
+	if err != nil {
+		// 返回证书指纹，前端可以让用户确认后添加到 pins
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) && len(certErr.UnverifiedCertificates) != 0 {
+			return nil, base.NewError(base.ErrCertUntrusted, err).WithData(certData(certErr.UnverifiedCertificates[0]))
+		}
+		return nil, err
+	}
+	return c.(*tls.Conn), nil
+}
+
+// HostWithPort 未指定端口时使用 443
+func HostWithPort(host string) string {
+	if strings.Contains(host, ":") {
+		return host
+	}
+	return host + ":443"
+}
+
+// 渲染模板并发送请求，ctx 取消或超时会中断请求并关闭连接
+func tplPost(ctx context.Context, conn *tls.Conn, bufR *bufio.Reader, prof *Profile, typ int, path string, dtd *proto.DTD) error {
 	tplBuffer := new(bytes.Buffer)
 	if typ == tplInit {
 		t, _ := template.New("init").Parse(templateInit)
-		_ = t.Execute(tplBuffer, Prof)
+		_ = t.Execute(tplBuffer, prof)
 	} else {
 		t, _ := template.New("auth_reply").Parse(templateAuthReply)
-		_ = t.Execute(tplBuffer, Prof)
+		_ = t.Execute(tplBuffer, prof)
 	}
 	if base.Cfg.LogLevel == "Debug" {
 		post := tplBuffer.String()
@@ -173,9 +326,9 @@ func tplPost(typ int, path string, dtd *proto.DTD) error {
 		}
 		base.Debug(post)
 	}
-	url := fmt.Sprintf("%s%s%s", Prof.Scheme, Prof.HostWithPort, path)
-	if Prof.SecretKey != "" {
-		url += "?" + Prof.SecretKey
+	url := fmt.Sprintf("%s%s%s", prof.Scheme, prof.HostWithPort, path)
+	if prof.SecretKey != "" {
+		url += "?" + prof.SecretKey
 	}
 	req, _ := http.NewRequest("POST", url, tplBuffer)
 
@@ -184,24 +337,27 @@ func tplPost(typ int, path string, dtd *proto.DTD) error {
 		req.Header[k] = []string{v}
 	}
 
-	err := req.Write(Conn)
+	stop := utils.WatchConn(ctx, conn, time.Duration(base.Cfg.AuthTimeout)*time.Second)
+	defer stop()
+
+	err := req.Write(conn)
 	if err != nil {
-		Conn.Close()
-		return err
+		conn.Close()
+		return utils.CtxErr(ctx, err)
 	}
 
 	var resp *http.Response
-	resp, err = http.ReadResponse(BufR, req)
+	resp, err = http.ReadResponse(bufR, req)
 	if err != nil {
-		Conn.Close()
-		return err
+		conn.Close()
+		return utils.CtxErr(ctx, err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		Conn.Close()
-		return err
+		conn.Close()
+		return utils.CtxErr(ctx, err)
 	}
 	if base.Cfg.LogLevel == "Debug" {
 		base.Debug(string(body))
@@ -224,8 +380,11 @@ func tplPost(typ int, path string, dtd *proto.DTD) error {
 		// nil
 		return err
 	}
-	Conn.Close()
-	return fmt.Errorf("auth error %s", resp.Status)
+	conn.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return base.Errorf(base.ErrAuthFailed, "auth error %s", resp.Status)
+	}
+	return base.Errorf(base.ErrServerError, "auth error %s", resp.Status)
 }
 
 var templateInit = `<?xml version="1.0" encoding="UTF-8"?>
@@ -247,9 +406,10 @@ var templateAuthReply = `<?xml version="1.0" encoding="UTF-8"?>
     <mac-address-list>
         <mac-address public-interface="true">{{.MacAddress}}</mac-address>
     </mac-address-list>
-    <auth>
+    <auth>{{if .AuthFields}}{{range .AuthFields}}
+        <{{.Name}}>{{.Value}}</{{.Name}}>{{end}}{{else}}
         <username>{{.Username}}</username>
-        <password>{{.Password}}</password>
+        <password>{{.Password}}</password>{{end}}
     </auth>
     <group-select>{{.Group}}</group-select>
 </config-auth>`
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"strings"
+
+	"sslcon/base"
+	"sslcon/proto"
+)
+
+// ServerInfo 仅发送 init 请求得到的服务端信息，不进行认证
+type ServerInfo struct {
+	Host            string      `json:"host"`
+	Groups          interface{} `json:"groups"` // 用户组的值和显示的名称
+	Action          string      `json:"action"`
+	Banner          string      `json:"banner,omitempty"`
+	Message         string      `json:"message,omitempty"`
+	CertFingerprint string      `json:"certFingerprint"` // 服务端证书 SHA-256 指纹，用于证书固定
+}
+
+// DiscoverGroups 使用独立的连接和 Profile，不读取正在连接的 Prof
+func DiscoverGroups(ctx context.Context, host, secret string) (*ServerInfo, error) {
+	prof := newProfile()
+	prof.Apply(&base.ConnProfile{Host: host, SecretKey: secret})
+	prof.HostWithPort = HostWithPort(host)
+	prof.AppVersion = base.Cfg.AgentVersion
+	prof.MacAddress = base.LocalInterface.Mac
+
+	conn, err := dial(ctx, prof)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dtd := new(proto.DTD)
+	err = tplPost(ctx, conn, bufio.NewReader(conn), prof, tplInit, "", dtd)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ServerInfo{
+		Host:    host,
+		Groups:  dtd.Auth.Form.Options,
+		Action:  dtd.Auth.Form.Action,
+		Banner:  strings.TrimSpace(dtd.Auth.Banner),
+		Message: strings.TrimSpace(dtd.Auth.Message),
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) != 0 {
+		info.CertFingerprint = fingerprint(certs[0])
+	}
+	return info, nil
+}
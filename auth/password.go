@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"regexp"
+	"strings"
+
+	"sslcon/base"
+	"sslcon/proto"
+	"sslcon/session"
+)
+
+// PromptPasswordChange 也是 session.Prompt.Kind
+const PromptPasswordChange = "password_change"
+
+// maxPasswordChange 新密码不符合服务端要求时允许重新输入的次数
+const maxPasswordChange = 3
+
+var fieldName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// changePassword 提示用户输入服务端要求的字段并提交，返回之后的响应，服务端要求重新登录时使用新密码
+func changePassword(ctx context.Context, dtd *proto.DTD) (*proto.DTD, error) {
+	defer func() {
+		Prof.AuthFields = nil
+	}()
+	changed := false
+	for i := 0; i < maxPasswordChange && dtd.Type == "auth-request" && dtd.Auth.PasswordChange(); i++ {
+		if session.Sess.Prompt == nil {
+			return nil, base.Errorf(base.ErrAuthFailed, "password expired, but %s", session.ErrNoFrontend)
+		}
+		p := &session.Prompt{Kind: PromptPasswordChange, Message: authMessage(dtd)}
+		var hidden []AuthField
+		for _, in := range dtd.Auth.Form.Inputs {
+			if !fieldName.MatchString(in.Name) {
+				continue
+			}
+			switch in.Type {
+			case "hidden":
+				hidden = append(hidden, AuthField{Name: in.Name, Value: escape(in.Value)})
+			case "submit", "reset":
+			default:
+				p.Fields = append(p.Fields, session.PromptField{Name: in.Name, Label: in.Label, Secret: in.Type == "password"})
+			}
+		}
+		reply, err := session.Sess.Prompt(ctx, p)
+		if errors.Is(err, session.ErrNoFrontend) {
+			return nil, base.Errorf(base.ErrAuthFailed, "password expired, but %w", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !reply.Accept {
+			return nil, base.Errorf(base.ErrAuthFailed, "password change cancelled")
+		}
+
+		Prof.AuthFields = hidden
+		newPassword := ""
+		for _, f := range p.Fields {
+			value := reply.Values[f.Name]
+			Prof.AuthFields = append(Prof.AuthFields, AuthField{Name: f.Name, Value: escape(value)})
+			if newPassword == "" && (proto.Input{Name: f.Name}).IsNewPassword() {
+				newPassword = value
+			}
+		}
+		if action := dtd.Auth.Form.Action; action != "" {
+			Prof.AuthPath = action
+		}
+		dtd = new(proto.DTD)
+		err = tplPost(ctx, Conn, BufR, Prof, tplAuthReply, Prof.AuthPath, dtd)
+		if err != nil {
+			return nil, err
+		}
+		if newPassword != "" {
+			Prof.Password = newPassword
+			changed = true
+		}
+	}
+	// 服务端不再要求修改即修改成功，否则 always-on 下次使用凭据库中的旧密码
+	if changed && !(dtd.Type == "auth-request" && (dtd.Auth.PasswordChange() || dtd.Auth.Error.Value != "")) {
+		saveChangedPassword()
+	}
+	// 部分服务端修改成功后要求重新登录
+	if dtd.Type == "auth-request" && !dtd.Auth.PasswordChange() && dtd.Auth.Error.Value == "" {
+		Prof.AuthFields = nil
+		dtd = new(proto.DTD)
+		err := tplPost(ctx, Conn, BufR, Prof, tplAuthReply, Prof.AuthPath, dtd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dtd, nil
+}
+
+// saveChangedPassword 只更新凭据库中已经保存的密码，保留 TOTP 种子和口令
+func saveChangedPassword() {
+	name := Prof.ProfileName
+	if name == "" {
+		return
+	}
+	info, err := base.Vault.Info(name)
+	if err != nil || info == nil || !info.HasPassword {
+		return
+	}
+	if info.Passphrase && Prof.Passphrase == "" {
+		base.Warn("password changed, but the saved credential of", name, "is protected by a passphrase, update it with sslcon credentials set")
+		return
+	}
+	cred, err := base.Vault.Open(name, Prof.CredentialScope(), Prof.Passphrase)
+	if err == nil {
+		cred.Password = Prof.Password
+		err = base.Vault.Set(name, Prof.CredentialScope(), cred, Prof.Passphrase)
+	}
+	if err != nil {
+		base.Error("password changed, but saving it failed:", err)
+		return
+	}
+	base.Info("saved the new password of", name)
+}
+
+// authMessage 服务端的提示和上次提交的错误
+func authMessage(dtd *proto.DTD) string {
+	msg := strings.TrimSpace(dtd.Auth.Message)
+	if e := strings.TrimSpace(strings.Replace(dtd.Auth.Error.Value, "%s", dtd.Auth.Error.Param1, 1)); e != "" {
+		msg = strings.TrimSpace(msg + "\n" + e)
+	}
+	if msg == "" {
+		msg = "Your password has expired, please change it."
+	}
+	return msg
+}
+
+func escape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
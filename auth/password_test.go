@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"sslcon/base"
+	"sslcon/proto"
+	"sslcon/session"
+)
+
+func TestMain(m *testing.M) {
+	base.Cfg.LogLevel = "Error"
+	base.Cfg.AuthTimeout = 5
+	base.InitLog()
+	os.Exit(m.Run())
+}
+
+const passwordChangeForm = `<?xml version="1.0" encoding="UTF-8"?>
+<config-auth client="vpn" type="auth-request" aggregate-auth-version="2"><auth id="passwd_chg"><message>Password expired</message>
+<error id="passwd_chg" param1="" param2="">%s</error>
+<form method="post" action="/auth"><input type="hidden" name="tok" value="x"/>
+<input type="password" name="new_password" label="New Password:"/><input type="password" name="verify_password" label="Verify Password:"/></form></auth></config-auth>`
+
+const authComplete = `<?xml version="1.0" encoding="UTF-8"?>
+<config-auth client="vpn" type="complete" aggregate-auth-version="2"><session-token>token</session-token></config-auth>`
+
+// fakePasswordServer 前 reject 次提交返回修改密码的表单，之后修改成功
+type fakePasswordServer struct {
+	mux    sync.Mutex
+	reject int
+	posts  []string
+}
+
+func (s *fakePasswordServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mux.Lock()
+	s.posts = append(s.posts, string(body))
+	n := len(s.posts)
+	s.mux.Unlock()
+	if n <= s.reject {
+		_, _ = fmt.Fprintf(w, passwordChangeForm, "Password does not meet the requirements")
+		return
+	}
+	_, _ = io.WriteString(w, authComplete)
+}
+
+// dialFake 使 tplPost 通过 Conn 和 BufR 访问测试服务端
+func dialFake(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	t.Cleanup(srv.Close)
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	oldConn, oldBufR, oldProf := Conn, BufR, Prof
+	Conn, BufR = conn, bufio.NewReader(conn)
+	Prof = &Profile{Scheme: "https://", HostWithPort: srv.Listener.Addr().String(), AuthPath: "/", Password: "old"}
+	t.Cleanup(func() { Conn, BufR, Prof = oldConn, oldBufR, oldProf })
+}
+
+func TestChangePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		reject   int
+		prompts  int
+		complete bool
+		password string
+	}{
+		{"accepted", 0, 1, true, "new1"},
+		{"accepted after retry", 2, 3, true, "new3"},
+		// 第 3 次提交后服务端仍然要求修改，不再提示
+		{"too many attempts", 3, maxPasswordChange, false, "new3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &fakePasswordServer{reject: tt.reject}
+			dialFake(t, srv)
+
+			var prompts []*session.Prompt
+			old := session.Sess.Prompt
+			session.Sess.Prompt = func(ctx context.Context, p *session.Prompt) (*session.PromptReply, error) {
+				prompts = append(prompts, p)
+				password := fmt.Sprintf("new%d", len(prompts))
+				return &session.PromptReply{Accept: true, Values: map[string]string{"new_password": password, "verify_password": password}}, nil
+			}
+			t.Cleanup(func() { session.Sess.Prompt = old })
+
+			dtd := new(proto.DTD)
+			if err := xml.Unmarshal([]byte(fmt.Sprintf(passwordChangeForm, "")), dtd); err != nil {
+				t.Fatal(err)
+			}
+			dtd, err := changePassword(context.Background(), dtd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(prompts) != tt.prompts || len(srv.posts) != tt.prompts {
+				t.Errorf("prompts = %d, posts = %d, want %d", len(prompts), len(srv.posts), tt.prompts)
+			}
+			if complete := dtd.Type == "complete"; complete != tt.complete {
+				t.Errorf("complete = %v, want %v", complete, tt.complete)
+			}
+			if Prof.Password != tt.password {
+				t.Errorf("Password = %s, want %s", Prof.Password, tt.password)
+			}
+			if Prof.AuthFields != nil {
+				t.Errorf("AuthFields = %v, want nil", Prof.AuthFields)
+			}
+			// 隐藏字段和新密码一起提交
+			for _, post := range srv.posts {
+				if !strings.Contains(post, "<tok>x</tok>") || !strings.Contains(post, "<new_password>new") {
+					t.Errorf("post = %s", post)
+				}
+			}
+			if len(prompts) > 1 && !strings.Contains(prompts[1].Message, "does not meet the requirements") {
+				t.Errorf("prompt message = %q", prompts[1].Message)
+			}
+		})
+	}
+}
+
+func TestChangePasswordCancelled(t *testing.T) {
+	srv := &fakePasswordServer{}
+	dialFake(t, srv)
+	old := session.Sess.Prompt
+	session.Sess.Prompt = func(ctx context.Context, p *session.Prompt) (*session.PromptReply, error) {
+		return &session.PromptReply{Accept: false}, nil
+	}
+	t.Cleanup(func() { session.Sess.Prompt = old })
+
+	dtd := new(proto.DTD)
+	if err := xml.Unmarshal([]byte(fmt.Sprintf(passwordChangeForm, "")), dtd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := changePassword(context.Background(), dtd); base.AsError(err).Code != base.ErrAuthFailed {
+		t.Errorf("changePassword = %v, want %s", err, base.ErrAuthFailed)
+	}
+	if len(srv.posts) != 0 || Prof.Password != "old" {
+		t.Errorf("posts = %d, Password = %s, want nothing sent", len(srv.posts), Prof.Password)
+	}
+}
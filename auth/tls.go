@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"sslcon/base"
+)
+
+// tlsConfig 客户端证书、CA 和证书固定来自连接配置
+func tlsConfig(prof *Profile) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: base.Cfg.InsecureSkipVerify,
+	}
+	if prof.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(prof.CertFile, prof.KeyFile)
+		if err != nil {
+			return nil, base.NewError(base.ErrInvalidParams, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if prof.CAFile != "" {
+		data, err := os.ReadFile(prof.CAFile)
+		if err != nil {
+			return nil, base.NewError(base.ErrInvalidParams, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, base.Errorf(base.ErrInvalidParams, "no certificate found in %s", prof.CAFile)
+		}
+		config.RootCAs = pool
+		config.InsecureSkipVerify = false
+	}
+	if len(prof.Pins) != 0 {
+		pins := prof.Pins
+		// 跳过证书验证时也会调用
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return base.Errorf(base.ErrCertUntrusted, "no server certificate")
+			}
+			fp := fingerprint(cs.PeerCertificates[0])
+			for _, pin := range pins {
+				if pin == fp {
+					return nil
+				}
+			}
+			return base.NewError(base.ErrCertUntrusted, fmt.Errorf("server certificate %s does not match any pin", fp)).WithData(certData(cs.PeerCertificates[0]))
+		}
+	}
+	return config, nil
+}
+
+// CertData 证书不受信任时错误的附加信息
+type CertData struct {
+	CertFingerprint string `json:"certFingerprint"`
+	Subject         string `json:"subject"`
+	Issuer          string `json:"issuer"`
+}
+
+func certData(cert *x509.Certificate) *CertData {
+	return &CertData{CertFingerprint: fingerprint(cert), Subject: cert.Subject.String(), Issuer: cert.Issuer.String()}
+}
+
+// fingerprint 证书的 SHA-256 指纹，与 ConnProfile.Pins 格式相同
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
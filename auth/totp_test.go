@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA-1 测试向量，种子为 ASCII "12345678901234567890"，取 8 位结果的后 6 位
+func TestTOTP(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totp(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("totp(%d) = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+// 身份验证器应用显示的种子可能是小写、带空格或者补齐了 =
+func TestTOTPSecretFormat(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, secret := range []string{"gezd gnbv gy3t qojq gezd gnbv gy3t qojq", "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ===="} {
+		code, err := totp(secret, now)
+		if err != nil || code != "287082" {
+			t.Errorf("totp(%q) = %s, %v, want 287082", secret, code, err)
+		}
+	}
+	if _, err := totp("not base32!", now); err == nil {
+		t.Error("totp accepted an invalid secret")
+	}
+}
@@ -0,0 +1,73 @@
+package base
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var (
+	AgentCfg = &AgentConfig{}
+	// ConfigDir vpnagent 配置目录，仅 root 或管理员可写
+	ConfigDir = configDir()
+	// StateDir vpnagent 运行时数据目录，如连接历史
+	StateDir = stateDir()
+)
+
+// AgentConfig vpnagent 启动时从 ConfigDir/vpnagent.json 读取，与 ClientConfig 不同，不能通过 rpc 修改
+type AgentConfig struct {
+	RPCAddr        []string `json:"rpc_addr"`        // WebSocket 监听地址，为空则不启用 WebSocket
+	RPCSocket      string   `json:"rpc_socket"`      // Unix socket 路径，仅 Linux，为空则不启用
+	AdminGroup     string   `json:"admin_group"`     // 通过 Unix socket 连接时，除 root 外可以修改连接状态的用户组
+	AllowedOrigins []string `json:"allowed_origins"` // 允许的浏览器 Origin，非浏览器客户端不发送 Origin
+	TokenGroup     string   `json:"token_group"`     // 可以读取 token 文件的用户组，Windows 无效
+	LegacyRPC      bool     `json:"legacy_rpc"`      // 兼容按照 ID 路由的旧版前端，前端也可以在握手时通过 api=2 关闭
+	MetricsAddr    string   `json:"metrics_addr"`    // Prometheus 监听地址，如 127.0.0.1:6211，为空则不启用
+
+	RequireBannerAcceptance bool `json:"require_banner_acceptance"` // 服务端下发 banner 时必须由用户确认才能继续连接，合规要求，前端不能关闭
+
+	AlwaysOn                string `json:"always_on"`                  // 启动时自动连接的连接配置，断开后一直重连，为空则不启用
+	AlwaysOnAllowDisconnect bool   `json:"always_on_allow_disconnect"` // 允许非 admin 的前端断开 always_on 连接
+	TrustedNetworkProfile   string `json:"trusted_network_profile"`    // 进行可信网络检测的连接配置，为空则使用 always_on
+}
+
+func configDir() string {
+	if runtime.GOOS == "windows" {
+		programData := os.Getenv("ProgramData")
+		if programData == "" {
+			programData = `C:\ProgramData`
+		}
+		return filepath.Join(programData, "sslcon")
+	}
+	return "/etc/sslcon"
+}
+
+func stateDir() string {
+	if runtime.GOOS == "windows" {
+		return configDir()
+	}
+	return "/var/lib/sslcon"
+}
+
+func initAgentCfg() {
+	AgentCfg.RPCAddr = []string{"127.0.0.1:6210", "[::1]:6210"}
+	AgentCfg.AllowedOrigins = []string{}
+	AgentCfg.TokenGroup = "sslcon"
+	AgentCfg.RPCSocket = "/run/sslcon/agent.sock"
+	AgentCfg.AdminGroup = "sslcon"
+	AgentCfg.LegacyRPC = true
+}
+
+// LoadAgentConfig 配置文件不存在时使用默认配置，sslcon 命令行也通过它获取 rpc 地址
+func LoadAgentConfig() error {
+	initAgentCfg()
+	data, err := os.ReadFile(filepath.Join(ConfigDir, "vpnagent.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, AgentCfg)
+}
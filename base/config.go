@@ -13,6 +13,19 @@ type ClientConfig struct {
 	NoDTLS             bool   `json:"no_dtls"`
 	AgentName          string `json:"agent_name"`
 	AgentVersion       string `json:"agent_version"`
+	PayloadInSize      int    `json:"payload_in_size"`  // PayloadIn 队列长度
+	PayloadOutSize     int    `json:"payload_out_size"` // PayloadOutTLS、PayloadOutDTLS 队列长度
+	DialTimeout        int    `json:"dial_timeout"`     // 以下均为秒，0 表示不限制
+	AuthTimeout        int    `json:"auth_timeout"`     // 每次认证请求
+	TunnelTimeout      int    `json:"tunnel_timeout"`   // CONNECT 请求
+	DTLSTimeout        int    `json:"dtls_timeout"`     // DTLS 握手
+	InputTimeout       int    `json:"input_timeout"`    // 等待用户确认或输入
+	DNSForwarder       string `json:"dns_forwarder"`    // 内置 DNS 转发器的监听地址，如 127.0.0.153，仅 Linux，为空则不启用
+	PolicyRouting      bool   `json:"policy_routing"`   // 仅 Linux，VPN 路由写入独立的路由表并通过 ip rule 选择，不修改主路由表
+	KillSwitch         bool   `json:"kill_switch"`      // 仅 Linux，只允许经过 VPN 的流量，重连期间保持，disconnect 时解除
+	KillSwitchLAN      bool   `json:"kill_switch_lan"`  // 断网保护允许访问物理网卡直连的网段
+
+	Overrides Overrides `json:"overrides"` // 所有连接共用，与连接配置的 overrides 合并
 }
 
 // Interface 应该由外部接口设置
@@ -29,4 +42,11 @@ func initCfg() {
 	Cfg.CiscoCompat = true
 	Cfg.AgentName = ""
 	Cfg.AgentVersion = "4.10.07062"
+	Cfg.PayloadInSize = 64
+	Cfg.PayloadOutSize = 64
+	Cfg.DialTimeout = 6
+	Cfg.AuthTimeout = 30
+	Cfg.TunnelTimeout = 30
+	Cfg.DTLSTimeout = 20
+	Cfg.InputTimeout = 300
 }
@@ -0,0 +1,143 @@
+package base
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrorCode 通过 rpc 返回给前端的错误码，数值一经发布不可修改
+type ErrorCode int
+
+const (
+	ErrUnknown ErrorCode = 1 // 兼容旧版前端，所有错误码均为 1
+
+	ErrInvalidParams    ErrorCode = 100
+	ErrPermissionDenied ErrorCode = 101
+	ErrUnknownMethod    ErrorCode = 102
+	ErrNotFound         ErrorCode = 103
+
+	ErrAuthFailed         ErrorCode = 200
+	ErrGroupRequired      ErrorCode = 201
+	ErrCertUntrusted      ErrorCode = 202
+	ErrBannerRejected     ErrorCode = 203
+	ErrPassphraseRequired ErrorCode = 204
+	ErrBadPassphrase      ErrorCode = 205
+
+	ErrNetworkUnreachable ErrorCode = 300
+	ErrTimeout            ErrorCode = 301
+	ErrServerError        ErrorCode = 302
+	ErrTunnelFailed       ErrorCode = 303
+
+	ErrTunCreateFailed ErrorCode = 400
+	ErrRoutingFailed   ErrorCode = 401
+
+	ErrAlreadyConnected ErrorCode = 500
+	ErrNotConnected     ErrorCode = 501
+	ErrCancelled        ErrorCode = 502
+	ErrConflict         ErrorCode = 503
+)
+
+var errorNames = map[ErrorCode]string{
+	ErrUnknown:            "unknown",
+	ErrInvalidParams:      "invalid_params",
+	ErrPermissionDenied:   "permission_denied",
+	ErrUnknownMethod:      "unknown_method",
+	ErrNotFound:           "not_found",
+	ErrAuthFailed:         "auth_failed",
+	ErrGroupRequired:      "group_required",
+	ErrCertUntrusted:      "cert_untrusted",
+	ErrBannerRejected:     "banner_rejected",
+	ErrPassphraseRequired: "passphrase_required",
+	ErrBadPassphrase:      "bad_passphrase",
+	ErrNetworkUnreachable: "network_unreachable",
+	ErrTimeout:            "timeout",
+	ErrServerError:        "server_error",
+	ErrTunnelFailed:       "tunnel_failed",
+	ErrTunCreateFailed:    "tun_create_failed",
+	ErrRoutingFailed:      "routing_failed",
+	ErrAlreadyConnected:   "already_connected",
+	ErrNotConnected:       "not_connected",
+	ErrCancelled:          "cancelled",
+	ErrConflict:           "conflict",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorNames[c]; ok {
+		return name
+	}
+	return errorNames[ErrUnknown]
+}
+
+// CodeError 带错误码的错误，Data 为附加的结构化信息，如可选的用户组
+type CodeError struct {
+	Code    ErrorCode
+	Message string
+	Data    interface{}
+	Err     error
+}
+
+func (e *CodeError) Error() string {
+	return e.Message
+}
+
+func (e *CodeError) Unwrap() error {
+	return e.Err
+}
+
+// NewError 以 err 作为错误信息
+func NewError(code ErrorCode, err error) *CodeError {
+	return &CodeError{Code: code, Message: err.Error(), Err: err}
+}
+
+// Errorf 以格式化字符串作为错误信息
+func Errorf(code ErrorCode, format string, a ...interface{}) *CodeError {
+	err := fmt.Errorf(format, a...)
+	return &CodeError{Code: code, Message: err.Error(), Err: errors.Unwrap(err)}
+}
+
+// WithData 附加结构化信息
+func (e *CodeError) WithData(data interface{}) *CodeError {
+	e.Data = data
+	return e
+}
+
+// AsError 已经分类的错误直接返回，否则根据错误类型推断错误码
+func AsError(err error) *CodeError {
+	if err == nil {
+		return nil
+	}
+	var e *CodeError
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(classify(err), err)
+}
+
+func classify(err error) ErrorCode {
+	var (
+		certErr     *tls.CertificateVerificationError
+		unknownAuth x509.UnknownAuthorityError
+		hostErr     x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+		netErr      net.Error
+		opErr       *net.OpError
+	)
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return ErrCertUntrusted
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrNetworkUnreachable
+	}
+	return ErrUnknown
+}
@@ -0,0 +1,299 @@
+package base
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Profiles 保存在 ConfigDir/profiles.json，只有 root 可以读写，不保存密码
+var Profiles = &profileStore{}
+
+// ConnProfile 命名的连接配置，sslcon connect <name> 或者 connect 方法的 profile 参数引用
+type ConnProfile struct {
+	Name       string    `json:"name"`
+	Host       string    `json:"host"`
+	Group      string    `json:"group,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	SecretKey  string    `json:"secret,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"` // password（默认）或者 certificate
+	CertFile   string    `json:"cert_file,omitempty"`   // 客户端证书和私钥，PEM 格式
+	KeyFile    string    `json:"key_file,omitempty"`
+	CAFile     string    `json:"ca_file,omitempty"` // 指定后总是验证服务端证书
+	Pins       []string  `json:"pins,omitempty"`    // 服务端证书 SHA-256 指纹，任意一个匹配即可
+	Overrides  Overrides `json:"overrides"`
+
+	TrustedNetwork *TrustedNetwork `json:"trusted_network,omitempty"`
+}
+
+// CredentialScope 保存凭据时绑定的服务端
+func (p *ConnProfile) CredentialScope() *CredentialScope {
+	return &CredentialScope{Host: p.Host, CAFile: p.CAFile, Pins: p.Pins}
+}
+
+// Redact 清除不能返回给无权限前端的字段
+func (p *ConnProfile) Redact() {
+	p.SecretKey = ""
+	p.CertFile = ""
+	p.KeyFile = ""
+	p.CAFile = ""
+}
+
+// TrustedNetwork 可信网络检测，配置的条件全部满足时认为处于可信网络，如公司内网
+type TrustedNetwork struct {
+	DNSDomains      []string `json:"dns_domains,omitempty"`      // 物理网卡的 search/domain 任意一个匹配
+	DNSServers      []string `json:"dns_servers,omitempty"`      // 物理网卡的 DNS 服务器全部在列表中
+	URL             string   `json:"url,omitempty"`              // 只能在可信网络访问的 HTTPS 地址
+	CertHash        string   `json:"cert_hash,omitempty"`        // URL 服务端证书 SHA-256 指纹
+	TrustedPolicy   string   `json:"trusted_policy,omitempty"`   // disconnect（默认）或者 none
+	UntrustedPolicy string   `json:"untrusted_policy,omitempty"` // connect（默认）或者 none
+}
+
+const (
+	PolicyNone       = "none"
+	PolicyConnect    = "connect"
+	PolicyDisconnect = "disconnect"
+)
+
+// Overrides 用户自定义的路由和 DNS，与服务端下发的配置合并
+type Overrides struct {
+	IncludeRoutes  []string `json:"include_routes,omitempty"` // CIDR 或者 IP
+	ExcludeRoutes  []string `json:"exclude_routes,omitempty"`
+	IncludeDomains []string `json:"include_domains,omitempty"`
+	ExcludeDomains []string `json:"exclude_domains,omitempty"`
+	DNSServers     []string `json:"dns_servers,omitempty"`
+	SearchDomains  []string `json:"search_domains,omitempty"`
+	NoDefaultRoute bool     `json:"no_default_route,omitempty"` // 忽略服务端下发的全局路由，只有包含路由经过 VPN
+
+	LocalLAN        bool `json:"local_lan,omitempty"`         // 全局模式下物理网卡直连的网段不经过 VPN，需要服务端允许
+	LocalLANPrivate bool `json:"local_lan_private,omitempty"` // 同时排除 RFC1918 私有网段
+}
+
+const (
+	AuthPassword    = "password"
+	AuthCertificate = "certificate"
+)
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// Validate 同时规范化证书指纹为小写、无冒号的十六进制
+func (p *ConnProfile) Validate() error {
+	if !profileName.MatchString(p.Name) {
+		return Errorf(ErrInvalidParams, "invalid profile name: %q", p.Name)
+	}
+	if p.Host == "" {
+		return Errorf(ErrInvalidParams, "missing host")
+	}
+	switch p.AuthMethod {
+	case "", AuthPassword:
+	case AuthCertificate:
+		if p.CertFile == "" || p.KeyFile == "" {
+			return Errorf(ErrInvalidParams, "certificate authentication requires cert_file and key_file")
+		}
+	default:
+		return Errorf(ErrInvalidParams, "unknown auth method: %s", p.AuthMethod)
+	}
+	for i, pin := range p.Pins {
+		pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+		if b, err := hex.DecodeString(pin); err != nil || len(b) != 32 {
+			return Errorf(ErrInvalidParams, "invalid pin: %s", p.Pins[i])
+		}
+		p.Pins[i] = pin
+	}
+	if p.TrustedNetwork != nil {
+		if err := p.TrustedNetwork.Validate(); err != nil {
+			return err
+		}
+	}
+	return p.Overrides.Validate()
+}
+
+// Validate 同时规范化证书指纹和域名
+func (t *TrustedNetwork) Validate() error {
+	if len(t.DNSDomains) == 0 && len(t.DNSServers) == 0 && t.URL == "" {
+		return Errorf(ErrInvalidParams, "trusted network requires dns_domains, dns_servers or url")
+	}
+	for i, d := range t.DNSDomains {
+		t.DNSDomains[i] = strings.ToLower(strings.TrimSuffix(d, "."))
+	}
+	for _, s := range t.DNSServers {
+		if net.ParseIP(s) == nil {
+			return Errorf(ErrInvalidParams, "invalid trusted dns server: %s", s)
+		}
+	}
+	if t.URL != "" {
+		if !strings.HasPrefix(t.URL, "https://") {
+			return Errorf(ErrInvalidParams, "trusted url must be https: %s", t.URL)
+		}
+		hash := strings.ToLower(strings.ReplaceAll(t.CertHash, ":", ""))
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+			return Errorf(ErrInvalidParams, "invalid trusted cert_hash: %s", t.CertHash)
+		}
+		t.CertHash = hash
+	}
+	switch t.TrustedPolicy {
+	case "", PolicyDisconnect, PolicyNone:
+	default:
+		return Errorf(ErrInvalidParams, "unknown trusted policy: %s", t.TrustedPolicy)
+	}
+	switch t.UntrustedPolicy {
+	case "", PolicyConnect, PolicyNone:
+	default:
+		return Errorf(ErrInvalidParams, "unknown untrusted policy: %s", t.UntrustedPolicy)
+	}
+	return nil
+}
+
+func (o *Overrides) Validate() error {
+	for _, routes := range [][]string{o.IncludeRoutes, o.ExcludeRoutes} {
+		for _, r := range routes {
+			if _, _, err := net.ParseCIDR(r); err != nil && net.ParseIP(r) == nil {
+				return Errorf(ErrInvalidParams, "invalid route: %s", r)
+			}
+		}
+	}
+	for _, s := range o.DNSServers {
+		if net.ParseIP(s) == nil {
+			return Errorf(ErrInvalidParams, "invalid dns server: %s", s)
+		}
+	}
+	return nil
+}
+
+// Merge 全局配置在前，连接配置在后，布尔值任意一个设置即生效
+func (o Overrides) Merge(p Overrides) Overrides {
+	return Overrides{
+		IncludeRoutes:  append(append([]string{}, o.IncludeRoutes...), p.IncludeRoutes...),
+		ExcludeRoutes:  append(append([]string{}, o.ExcludeRoutes...), p.ExcludeRoutes...),
+		IncludeDomains: append(append([]string{}, o.IncludeDomains...), p.IncludeDomains...),
+		ExcludeDomains: append(append([]string{}, o.ExcludeDomains...), p.ExcludeDomains...),
+		DNSServers:     append(append([]string{}, o.DNSServers...), p.DNSServers...),
+		SearchDomains:  append(append([]string{}, o.SearchDomains...), p.SearchDomains...),
+		NoDefaultRoute: o.NoDefaultRoute || p.NoDefaultRoute,
+
+		LocalLAN:        o.LocalLAN || p.LocalLAN,
+		LocalLANPrivate: o.LocalLANPrivate || p.LocalLANPrivate,
+	}
+}
+
+type profileStore struct {
+	mux sync.Mutex
+}
+
+func profilesFile() string {
+	return filepath.Join(ConfigDir, "profiles.json")
+}
+
+// List 每次都读取文件，手动修改后无需重启
+func (s *profileStore) List() ([]*ConnProfile, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.load()
+}
+
+func (s *profileStore) Get(name string) (*ConnProfile, error) {
+	profiles, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, Errorf(ErrNotFound, "profile not found: %s", name)
+}
+
+func (s *profileStore) Create(p *ConnProfile) error {
+	return s.modify(p.Name, func(profiles []*ConnProfile, i int) ([]*ConnProfile, error) {
+		if i >= 0 {
+			return nil, Errorf(ErrConflict, "profile already exists: %s", p.Name)
+		}
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		return append(profiles, p), nil
+	})
+}
+
+func (s *profileStore) Update(p *ConnProfile) error {
+	return s.modify(p.Name, func(profiles []*ConnProfile, i int) ([]*ConnProfile, error) {
+		if i < 0 {
+			return nil, Errorf(ErrNotFound, "profile not found: %s", p.Name)
+		}
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		profiles[i] = p
+		return profiles, nil
+	})
+}
+
+func (s *profileStore) Delete(name string) error {
+	return s.modify(name, func(profiles []*ConnProfile, i int) ([]*ConnProfile, error) {
+		if i < 0 {
+			return nil, Errorf(ErrNotFound, "profile not found: %s", name)
+		}
+		return append(profiles[:i], profiles[i+1:]...), nil
+	})
+}
+
+// modify 在锁内读取、修改并保存，i 为同名配置的下标，不存在时为 -1
+func (s *profileStore) modify(name string, f func(profiles []*ConnProfile, i int) ([]*ConnProfile, error)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	profiles, err := s.load()
+	if err != nil {
+		return err
+	}
+	i := -1
+	for j, p := range profiles {
+		if p.Name == name {
+			i = j
+			break
+		}
+	}
+	profiles, err = f(profiles, i)
+	if err != nil {
+		return err
+	}
+	return s.save(profiles)
+}
+
+func (s *profileStore) load() ([]*ConnProfile, error) {
+	data, err := os.ReadFile(profilesFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*ConnProfile{}, nil
+		}
+		return nil, err
+	}
+	var profiles []*ConnProfile
+	err = json.Unmarshal(data, &profiles)
+	return profiles, err
+}
+
+// save 先写临时文件再重命名，避免写入中断损坏配置
+func (s *profileStore) save(profiles []*ConnProfile) error {
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(ConfigDir, 0755); err != nil {
+		return err
+	}
+	tmp := profilesFile() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, profilesFile())
+}
@@ -0,0 +1,219 @@
+package base
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverridesMerge(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  Overrides
+		profile Overrides
+		want    Overrides
+	}{
+		{
+			name: "empty",
+			want: Overrides{IncludeRoutes: []string{}, ExcludeRoutes: []string{}, IncludeDomains: []string{}, ExcludeDomains: []string{},
+				DNSServers: []string{}, SearchDomains: []string{}},
+		},
+		{
+			name:   "global only",
+			global: Overrides{IncludeRoutes: []string{"10.1.0.0/16"}, DNSServers: []string{"10.1.0.53"}, LocalLAN: true},
+			want: Overrides{IncludeRoutes: []string{"10.1.0.0/16"}, ExcludeRoutes: []string{}, IncludeDomains: []string{}, ExcludeDomains: []string{},
+				DNSServers: []string{"10.1.0.53"}, SearchDomains: []string{}, LocalLAN: true},
+		},
+		{
+			name: "global first, then profile",
+			global: Overrides{
+				IncludeRoutes:  []string{"10.1.0.0/16"},
+				ExcludeDomains: []string{"cdn.example"},
+				SearchDomains:  []string{"corp.example"},
+			},
+			profile: Overrides{
+				IncludeRoutes:   []string{"10.2.0.0/16"},
+				ExcludeRoutes:   []string{"10.1.5.0/24"},
+				IncludeDomains:  []string{"git.example"},
+				DNSServers:      []string{"10.2.0.53"},
+				SearchDomains:   []string{"lab.example"},
+				NoDefaultRoute:  true,
+				LocalLANPrivate: true,
+			},
+			want: Overrides{
+				IncludeRoutes:   []string{"10.1.0.0/16", "10.2.0.0/16"},
+				ExcludeRoutes:   []string{"10.1.5.0/24"},
+				IncludeDomains:  []string{"git.example"},
+				ExcludeDomains:  []string{"cdn.example"},
+				DNSServers:      []string{"10.2.0.53"},
+				SearchDomains:   []string{"corp.example", "lab.example"},
+				NoDefaultRoute:  true,
+				LocalLANPrivate: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.global.Merge(tt.profile)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 合并结果不能与全局配置共用底层数组，否则连接配置的值会写入全局配置
+func TestOverridesMergeCopies(t *testing.T) {
+	routes := make([]string, 1, 4)
+	routes[0] = "10.1.0.0/16"
+	global := Overrides{IncludeRoutes: routes}
+	got := global.Merge(Overrides{IncludeRoutes: []string{"10.2.0.0/16"}})
+	got.IncludeRoutes[0] = "10.9.0.0/16"
+	_ = global.Merge(Overrides{IncludeRoutes: []string{"10.3.0.0/16"}})
+	if global.IncludeRoutes[0] != "10.1.0.0/16" || len(global.IncludeRoutes) != 1 {
+		t.Errorf("global overrides changed: %v", global.IncludeRoutes)
+	}
+	if routes[:2][1] != "" {
+		t.Errorf("global backing array changed: %v", routes[:2])
+	}
+}
+
+func TestProfileStore(t *testing.T) {
+	tempConfigDir(t)
+	pin := "AB:" + strings.Repeat("cd", 31)
+
+	profiles, err := Profiles.List()
+	if err != nil || len(profiles) != 0 {
+		t.Fatalf("List = %v, %v, want empty", profiles, err)
+	}
+	if err = Profiles.Create(&ConnProfile{Name: "work", Host: "vpn.example.com", Pins: []string{pin}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Profiles.Create(&ConnProfile{Name: "home", Host: "home.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Profiles.Create(&ConnProfile{Name: "work", Host: "other.example.com"}); AsError(err).Code != ErrConflict {
+		t.Errorf("Create duplicate = %v, want %s", err, ErrConflict)
+	}
+
+	p, err := Profiles.Get("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 指纹保存时已经规范化
+	if p.Host != "vpn.example.com" || !reflect.DeepEqual(p.Pins, []string{"ab" + strings.Repeat("cd", 31)}) {
+		t.Errorf("Get = %+v", p)
+	}
+
+	p.Group = "eng"
+	if err = Profiles.Update(p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = Profiles.Get("work"); err != nil || p.Group != "eng" {
+		t.Errorf("Get after Update = %+v, %v", p, err)
+	}
+	if err = Profiles.Update(&ConnProfile{Name: "none", Host: "vpn.example.com"}); AsError(err).Code != ErrNotFound {
+		t.Errorf("Update missing = %v, want %s", err, ErrNotFound)
+	}
+	// 验证失败时不修改已保存的配置
+	if err = Profiles.Update(&ConnProfile{Name: "work"}); AsError(err).Code != ErrInvalidParams {
+		t.Errorf("Update invalid = %v, want %s", err, ErrInvalidParams)
+	}
+	if p, err = Profiles.Get("work"); err != nil || p.Host != "vpn.example.com" {
+		t.Errorf("Get after invalid Update = %+v, %v", p, err)
+	}
+
+	profiles, err = Profiles.List()
+	if err != nil || len(profiles) != 2 || profiles[0].Name != "home" || profiles[1].Name != "work" {
+		t.Errorf("List = %v, %v, want home and work", profiles, err)
+	}
+
+	if err = Profiles.Delete("home"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Profiles.Get("home"); AsError(err).Code != ErrNotFound {
+		t.Errorf("Get deleted = %v, want %s", err, ErrNotFound)
+	}
+	if err = Profiles.Delete("home"); AsError(err).Code != ErrNotFound {
+		t.Errorf("Delete missing = %v, want %s", err, ErrNotFound)
+	}
+	if profiles, err = Profiles.List(); err != nil || len(profiles) != 1 {
+		t.Errorf("List = %v, %v, want work", profiles, err)
+	}
+}
+
+func TestProfileValidate(t *testing.T) {
+	pin := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		profile ConnProfile
+		valid   bool
+	}{
+		{"valid", ConnProfile{Name: "work-1.eng_2", Host: "vpn.example.com"}, true},
+		{"empty name", ConnProfile{Host: "vpn.example.com"}, false},
+		{"name with slash", ConnProfile{Name: "../work", Host: "vpn.example.com"}, false},
+		{"name starts with dot", ConnProfile{Name: ".work", Host: "vpn.example.com"}, false},
+		{"name too long", ConnProfile{Name: strings.Repeat("a", 65), Host: "vpn.example.com"}, false},
+		{"missing host", ConnProfile{Name: "work"}, false},
+		{"certificate", ConnProfile{Name: "work", Host: "vpn.example.com", AuthMethod: AuthCertificate, CertFile: "c.pem", KeyFile: "k.pem"}, true},
+		{"certificate without key", ConnProfile{Name: "work", Host: "vpn.example.com", AuthMethod: AuthCertificate, CertFile: "c.pem"}, false},
+		{"unknown auth method", ConnProfile{Name: "work", Host: "vpn.example.com", AuthMethod: "saml"}, false},
+		{"pin", ConnProfile{Name: "work", Host: "vpn.example.com", Pins: []string{pin}}, true},
+		{"short pin", ConnProfile{Name: "work", Host: "vpn.example.com", Pins: []string{"abcd"}}, false},
+		{"invalid route", ConnProfile{Name: "work", Host: "vpn.example.com", Overrides: Overrides{IncludeRoutes: []string{"10.0.0.0/33"}}}, false},
+		{"invalid dns", ConnProfile{Name: "work", Host: "vpn.example.com", Overrides: Overrides{DNSServers: []string{"dns.example"}}}, false},
+		{"trusted network", ConnProfile{Name: "work", Host: "vpn.example.com",
+			TrustedNetwork: &TrustedNetwork{URL: "https://intranet.example", CertHash: pin}}, true},
+		{"empty trusted network", ConnProfile{Name: "work", Host: "vpn.example.com", TrustedNetwork: &TrustedNetwork{}}, false},
+		{"trusted url without hash", ConnProfile{Name: "work", Host: "vpn.example.com",
+			TrustedNetwork: &TrustedNetwork{URL: "https://intranet.example"}}, false},
+		{"unknown trusted policy", ConnProfile{Name: "work", Host: "vpn.example.com",
+			TrustedNetwork: &TrustedNetwork{DNSDomains: []string{"corp.example"}, TrustedPolicy: "reconnect"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.profile.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("Validate = %v", err)
+			}
+			if !tt.valid && AsError(err).Code != ErrInvalidParams {
+				t.Errorf("Validate = %v, want %s", err, ErrInvalidParams)
+			}
+		})
+	}
+}
+
+// 无权限的前端只能看到连接所需的公开信息
+func TestProfileRedact(t *testing.T) {
+	p := &ConnProfile{
+		Name:       "work",
+		Host:       "vpn.example.com",
+		Group:      "eng",
+		Username:   "alice",
+		SecretKey:  "secret",
+		AuthMethod: AuthCertificate,
+		CertFile:   "/etc/sslcon/work.pem",
+		KeyFile:    "/etc/sslcon/work.key",
+		CAFile:     "/etc/sslcon/ca.pem",
+		Pins:       []string{strings.Repeat("ab", 32)},
+	}
+	p.Redact()
+	want := &ConnProfile{
+		Name:       "work",
+		Host:       "vpn.example.com",
+		Group:      "eng",
+		Username:   "alice",
+		AuthMethod: AuthCertificate,
+		Pins:       []string{strings.Repeat("ab", 32)},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("Redact = %+v, want %+v", p, want)
+	}
+	data, _ := json.Marshal(p)
+	for _, key := range []string{"secret", "cert_file", "key_file", "ca_file"} {
+		if strings.Contains(string(data), `"`+key+`"`) {
+			t.Errorf("%s in %s", key, data)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package base
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/go-sysinfo"
+	"golang.org/x/crypto/argon2"
+)
+
+// Vault 按连接配置名称加密保存的凭据，保存在 ConfigDir/credentials.json，只有 root 可以读写
+var Vault = &vault{}
+
+// Credential 解密后的凭据，不能写入日志或者返回给前端
+type Credential struct {
+	Password   string `json:"password,omitempty"`
+	TOTPSecret string `json:"totp_secret,omitempty"` // Base32 编码的 TOTP 种子，用于两步登陆
+}
+
+// CredentialInfo 不包含凭据本身，可以返回给前端
+type CredentialInfo struct {
+	Profile     string    `json:"profile"`
+	Host        string    `json:"host"` // 保存时的服务器，服务器、CA 或者证书指纹变化后需要重新保存
+	HasPassword bool      `json:"has_password"`
+	HasTOTP     bool      `json:"has_totp"`
+	Passphrase  bool      `json:"passphrase"` // 解密时需要用户口令
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type sealedCredential struct {
+	CredentialInfo
+	Salt  []byte `json:"salt,omitempty"`
+	Check []byte `json:"check,omitempty"` // 口令派生密钥的摘要，用于区分口令错误和服务端变化
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// CredentialScope 凭据绑定的服务端，作为附加数据参与加密，连接其它服务器时无法解密，防止密码被发送到修改后的服务器
+type CredentialScope struct {
+	Host   string
+	CAFile string
+	Pins   []string
+}
+
+// aad 主机名小写并补全端口，CA 包括文件内容，指纹规范化后排序
+func (s *CredentialScope) aad(profile string) ([]byte, error) {
+	host := strings.ToLower(s.Host)
+	if !strings.Contains(host, ":") {
+		host += ":443"
+	}
+	ca := ""
+	if s.CAFile != "" {
+		data, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, NewError(ErrInvalidParams, err)
+		}
+		sum := sha256.Sum256(data)
+		ca = s.CAFile + "#" + hex.EncodeToString(sum[:])
+	}
+	pins := make([]string, 0, len(s.Pins))
+	for _, pin := range s.Pins {
+		pins = append(pins, strings.ToLower(strings.ReplaceAll(pin, ":", "")))
+	}
+	sort.Strings(pins)
+	return json.Marshal([]string{profile, host, ca, strings.Join(pins, ",")})
+}
+
+// Argon2id 参数，修改后已保存的凭据无法解密
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+)
+
+type vault struct {
+	mux sync.Mutex
+}
+
+func credentialsFile() string {
+	return filepath.Join(ConfigDir, "credentials.json")
+}
+
+func vaultKeyFile() string {
+	return filepath.Join(ConfigDir, "vault.key")
+}
+
+// Set 覆盖已有凭据，passphrase 为空则只使用机器密钥，scope 为连接配置当前的服务端
+func (v *vault) Set(profile string, scope *CredentialScope, cred *Credential, passphrase string) error {
+	if !profileName.MatchString(profile) {
+		return Errorf(ErrInvalidParams, "invalid profile name: %q", profile)
+	}
+	if cred.Password == "" && cred.TOTPSecret == "" {
+		return Errorf(ErrInvalidParams, "empty credential")
+	}
+	aad, err := scope.aad(profile)
+	if err != nil {
+		return err
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	machineKey, err := loadMachineKey(true)
+	if err != nil {
+		return err
+	}
+	s := &sealedCredential{CredentialInfo: CredentialInfo{
+		Profile:     profile,
+		Host:        scope.Host,
+		HasPassword: cred.Password != "",
+		HasTOTP:     cred.TOTPSecret != "",
+		Passphrase:  passphrase != "",
+		UpdatedAt:   time.Now(),
+	}}
+	var userKey []byte
+	if passphrase != "" {
+		s.Salt = make([]byte, 16)
+		if _, err = rand.Read(s.Salt); err != nil {
+			return err
+		}
+		userKey = passphraseKey(passphrase, s.Salt)
+		s.Check = passphraseCheck(userKey)
+	}
+	aead, err := newAEAD(machineKey, userKey)
+	if err != nil {
+		return err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(s.Nonce); err != nil {
+		return err
+	}
+	plain, _ := json.Marshal(cred)
+	// 以名称和服务端作为附加数据，防止凭据被挪用到其它连接配置或者服务器
+	s.Data = aead.Seal(nil, s.Nonce, plain, aad)
+
+	all, err := v.load()
+	if err != nil {
+		return err
+	}
+	all[profile] = s
+	return v.save(all)
+}
+
+// Open 凭据不存在时返回 ErrNotFound，scope 为本次连接实际使用的服务端
+func (v *vault) Open(profile string, scope *CredentialScope, passphrase string) (*Credential, error) {
+	aad, err := scope.aad(profile)
+	if err != nil {
+		return nil, err
+	}
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	all, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	s, ok := all[profile]
+	if !ok {
+		return nil, Errorf(ErrNotFound, "no credential stored for %s", profile)
+	}
+	if s.Passphrase && passphrase == "" {
+		return nil, Errorf(ErrPassphraseRequired, "passphrase required for the credential of %s", profile)
+	}
+	machineKey, err := loadMachineKey(false)
+	if err != nil {
+		return nil, err
+	}
+	var userKey []byte
+	if s.Passphrase {
+		userKey = passphraseKey(passphrase, s.Salt)
+		if s.Check != nil && subtle.ConstantTimeCompare(passphraseCheck(userKey), s.Check) != 1 {
+			return nil, Errorf(ErrBadPassphrase, "wrong passphrase for the credential of %s", profile)
+		}
+	}
+	aead, err := newAEAD(machineKey, userKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Data, aad)
+	if err != nil {
+		// 服务端变化、密钥文件变化或者复制到了其它机器，重新输入口令无法解决
+		return nil, Errorf(ErrAuthFailed, "unable to decrypt the credential of %s, the server, CA or pins changed, save it again", profile)
+	}
+	cred := new(Credential)
+	err = json.Unmarshal(plain, cred)
+	return cred, err
+}
+
+// Info 凭据不存在时返回 nil
+func (v *vault) Info(profile string) (*CredentialInfo, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	all, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := all[profile]; ok {
+		return &s.CredentialInfo, nil
+	}
+	return nil, nil
+}
+
+func (v *vault) List() ([]CredentialInfo, error) {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	all, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]CredentialInfo, 0, len(all))
+	for _, s := range all {
+		infos = append(infos, s.CredentialInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Profile < infos[j].Profile
+	})
+	return infos, nil
+}
+
+func (v *vault) Clear(profile string) error {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	all, err := v.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := all[profile]; !ok {
+		return Errorf(ErrNotFound, "no credential stored for %s", profile)
+	}
+	delete(all, profile)
+	return v.save(all)
+}
+
+func (v *vault) load() (map[string]*sealedCredential, error) {
+	all := make(map[string]*sealedCredential)
+	data, err := os.ReadFile(credentialsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return all, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &all)
+	return all, err
+}
+
+func (v *vault) save(all map[string]*sealedCredential) error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(ConfigDir, 0755); err != nil {
+		return err
+	}
+	tmp := credentialsFile() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, credentialsFile())
+}
+
+// loadMachineKey 随机密钥文件与机器标识共同派生，复制到其它机器后无法解密
+func loadMachineKey(create bool) ([]byte, error) {
+	key, err := os.ReadFile(vaultKeyFile())
+	if os.IsNotExist(err) && create {
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(ConfigDir, 0755); err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(vaultKeyFile(), key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(key)
+	if host, err := sysinfo.Host(); err == nil {
+		h.Write([]byte(host.Info().UniqueID))
+	}
+	return h.Sum(nil), nil
+}
+
+func passphraseKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, argonTime, argonMemory, argonThreads, 32)
+}
+
+// passphraseCheck 与加密密钥不同，泄露后只能用于离线验证口令，与 Argon2id 的代价相同
+func passphraseCheck(userKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("sslcon passphrase check "), userKey...))
+	return sum[:]
+}
+
+// newAEAD userKey 为空时只使用机器密钥
+func newAEAD(machineKey, userKey []byte) (cipher.AEAD, error) {
+	key := machineKey
+	if userKey != nil {
+		sum := sha256.Sum256(append(append([]byte{}, machineKey...), userKey...))
+		key = sum[:]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
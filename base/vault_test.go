@@ -0,0 +1,157 @@
+package base
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultRoundTrip(t *testing.T) {
+	tempConfigDir(t)
+	scope := &CredentialScope{Host: "vpn.example.com"}
+	cred := &Credential{Password: "123456", TOTPSecret: "JBSWY3DPEHPK3PXP"}
+
+	tests := []struct {
+		name       string
+		passphrase string
+	}{
+		{"machine key", ""},
+		{"passphrase", "correct horse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Vault.Set("work", scope, cred, tt.passphrase); err != nil {
+				t.Fatal(err)
+			}
+			// 主机名大小写和默认端口不影响解密
+			got, err := Vault.Open("work", &CredentialScope{Host: "VPN.example.com:443"}, tt.passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *cred {
+				t.Errorf("Open = %+v, want %+v", got, cred)
+			}
+			info, err := Vault.Info("work")
+			if err != nil || info == nil {
+				t.Fatalf("Info = %v, %v", info, err)
+			}
+			if !info.HasPassword || !info.HasTOTP || info.Passphrase != (tt.passphrase != "") {
+				t.Errorf("Info = %+v", info)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(credentialsFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{cred.Password, cred.TOTPSecret} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("%s saved in plain text", secret)
+		}
+	}
+}
+
+func TestVaultScope(t *testing.T) {
+	tempConfigDir(t)
+	ca := filepath.Join(ConfigDir, "ca.pem")
+	if err := os.WriteFile(ca, []byte("ca 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := &CredentialScope{Host: "vpn.example.com", CAFile: ca, Pins: []string{"AB:CD", "ef01"}}
+	if err := Vault.Set("work", saved, &Credential{Password: "123456"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		scope   *CredentialScope
+		code    ErrorCode
+	}{
+		{"pins normalized", "work", &CredentialScope{Host: "vpn.example.com", CAFile: ca, Pins: []string{"EF01", "abcd"}}, 0},
+		{"other server", "work", &CredentialScope{Host: "evil.example.com", CAFile: ca, Pins: saved.Pins}, ErrAuthFailed},
+		{"other port", "work", &CredentialScope{Host: "vpn.example.com:8443", CAFile: ca, Pins: saved.Pins}, ErrAuthFailed},
+		{"no CA", "work", &CredentialScope{Host: "vpn.example.com", Pins: saved.Pins}, ErrAuthFailed},
+		{"other pins", "work", &CredentialScope{Host: "vpn.example.com", CAFile: ca, Pins: []string{"abcd"}}, ErrAuthFailed},
+		{"other profile", "home", saved, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Vault.Open(tt.profile, tt.scope, "")
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || AsError(err).Code != tt.code {
+				t.Errorf("Open = %v, want %s", err, tt.code)
+			}
+		})
+	}
+
+	// CA 文件内容变化
+	if err := os.WriteFile(ca, []byte("ca 2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Vault.Open("work", saved, ""); err == nil || AsError(err).Code != ErrAuthFailed {
+		t.Errorf("Open with another CA = %v, want %s", err, ErrAuthFailed)
+	}
+}
+
+func TestVaultTampered(t *testing.T) {
+	tempConfigDir(t)
+	scope := &CredentialScope{Host: "vpn.example.com"}
+	if err := Vault.Set("work", scope, &Credential{Password: "123456"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	all, err := Vault.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all["work"].Data[0] ^= 1
+	if err = Vault.save(all); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Vault.Open("work", scope, ""); err == nil || AsError(err).Code != ErrAuthFailed {
+		t.Errorf("Open = %v, want %s", err, ErrAuthFailed)
+	}
+}
+
+func TestVaultPassphrase(t *testing.T) {
+	tempConfigDir(t)
+	scope := &CredentialScope{Host: "vpn.example.com"}
+	if err := Vault.Set("work", scope, &Credential{Password: "123456"}, "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		passphrase string
+		scope      *CredentialScope
+		code       ErrorCode
+	}{
+		{"missing", "", scope, ErrPassphraseRequired},
+		{"wrong", "battery staple", scope, ErrBadPassphrase},
+		// 口令正确时服务端变化不能报告为口令错误
+		{"other server", "correct horse", &CredentialScope{Host: "evil.example.com"}, ErrAuthFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Vault.Open("work", tt.scope, tt.passphrase)
+			if err == nil || AsError(err).Code != tt.code {
+				t.Errorf("Open = %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+// tempConfigDir 测试结束后恢复 ConfigDir
+func tempConfigDir(t *testing.T) {
+	t.Helper()
+	old := ConfigDir
+	ConfigDir = t.TempDir()
+	t.Cleanup(func() { ConfigDir = old })
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/spf13/cobra"
+	"sslcon/utils/vpnc"
+)
+
+var cleanup = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Roll back the routes and DNS settings left over by a crashed agent",
+	Run: func(cmd *cobra.Command, args []string) {
+		// 由 agent 回滚，agent 未运行时才在本地执行，需要 root 权限
+		var entries []vpnc.JournalEntry
+		err := rpcCall("cleanup", nil, &entries)
+		var jError *jsonrpc2.Error
+		if err != nil && !errors.As(err, &jError) {
+			entries, err = vpnc.Cleanup(false)
+		}
+		if len(entries) == 0 && err == nil {
+			fmt.Println("Nothing to clean up")
+			return
+		}
+		if len(entries) > 0 {
+			data, _ := json.MarshalIndent(entries, "", "  ")
+			fmt.Println(string(data))
+		}
+		if err != nil {
+			printError(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanup)
+}
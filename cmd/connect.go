@@ -3,12 +3,14 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/apieasy/gson"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh/terminal"
-	"sslcon/rpc"
+	"sslcon/base"
 )
 
 var (
@@ -20,58 +22,117 @@ var (
 
 	logLevel string
 	logPath  string
+
+	dnsForwarder  string
+	policyRouting bool
+	killSwitch    bool
+	killSwitchLAN bool
 )
 
 var connect = &cobra.Command{
-	Use:   "connect",
+	Use:   "connect [profile]",
 	Short: "Connect to the VPN server",
-	// Args:  cobra.MinimumNArgs(1), // 至少1个非选项参数
+	Long:  "Connect to the VPN server given by the flags, or by a profile stored in the agent, where the flags override the profile",
+	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if host == "" || username == "" {
-			cmd.Help()
-		} else {
-			if password == "" {
-				fmt.Print("Enter your password:")
-				bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
-				if err != nil {
-					fmt.Println("Error reading password:", err)
-					return
-				}
-				password = string(bytePassword)
-				fmt.Println()
+		params := make(map[string]string)
+		askPassword := password == ""
+		if len(args) == 1 {
+			profile := new(base.ConnProfile)
+			err := rpcCall("profile.get", map[string]string{"name": args[0]}, profile)
+			if err != nil {
+				printError(err)
+				return
 			}
-			// fmt.Println(host, username, password, group)
-			if password != "" {
-				params := make(map[string]string)
-				params["log_level"] = logLevel
-				params["log_path"] = logPath
-
-				result := gson.New()
-				err := rpcCall("config", params, result, rpc.CONFIG)
-				if err != nil {
-					after, _ := strings.CutPrefix(err.Error(), "jsonrpc2: code 1 message: ")
-					fmt.Println(after)
-				} else {
-					params := make(map[string]string)
-					params["host"] = host
-					params["username"] = username
-					params["password"] = password
-					params["group"] = group
-					params["secret"] = secret
-
-					err := rpcCall("connect", params, result, rpc.CONNECT)
+			params["profile"] = args[0]
+			if profile.AuthMethod == base.AuthCertificate {
+				askPassword = false
+			}
+			// 使用保存的密码，口令保护时需要输入口令
+			if cred := savedCredential(args[0]); cred != nil && cred.HasPassword && askPassword {
+				askPassword = false
+				if cred.Passphrase {
+					params["passphrase"], err = readSecret("Enter the passphrase:")
 					if err != nil {
-						after, _ := strings.CutPrefix(err.Error(), "jsonrpc2: code 1 message: ")
-						fmt.Println(after)
-					} else {
-						result.Print()
+						fmt.Println("Error reading passphrase:", err)
+						return
 					}
 				}
 			}
+		} else if host == "" || username == "" {
+			cmd.Help()
+			return
+		}
+		if askPassword {
+			fmt.Print("Enter your password:")
+			bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+			if err != nil {
+				fmt.Println("Error reading password:", err)
+				return
+			}
+			password = string(bytePassword)
+			fmt.Println()
+			if password == "" {
+				return
+			}
+		}
+		// fmt.Println(host, username, password, group)
+		config := make(map[string]interface{})
+		config["log_level"] = logLevel
+		config["log_path"] = logPath
+		// 未指定的参数不发送，保留 vpnagent 中已有的配置
+		for flag, v := range map[string]interface{}{"dns-forwarder": dnsForwarder, "policy-routing": policyRouting,
+			"kill-switch": killSwitch, "kill-switch-lan": killSwitchLAN} {
+			if cmd.Flags().Changed(flag) {
+				config[strings.ReplaceAll(flag, "-", "_")] = v
+			}
+		}
+
+		result := gson.New()
+		err := rpcCall("config", config, result)
+		if err != nil {
+			printError(err)
+			return
+		}
+		// 使用连接配置时只发送命令行指定的参数
+		for k, v := range map[string]string{"host": host, "username": username, "password": password, "group": group, "secret": secret} {
+			if v != "" || params["profile"] == "" {
+				params[k] = v
+			}
+		}
+		err = connectOrAbort(params, result)
+		if err != nil {
+			printError(err)
+		} else {
+			result.Print()
 		}
 	},
 }
 
+// connectOrAbort Ctrl+C 时通知 vpnagent 中断连接过程，并等待 connect 返回
+func connectOrAbort(params map[string]string, result *gson.Gson) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- rpcCallWith(&handler{notify: promptUser}, "connect", params, result)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-sigs:
+		fmt.Println("cancelling...")
+		err := rpcCall("abort", nil, gson.New())
+		if err != nil {
+			return err
+		}
+		return <-done
+	}
+}
+
 func init() {
 	// 子命令自己被编译、添加到主命令当中
 	rootCmd.AddCommand(connect)
@@ -85,4 +146,8 @@ func init() {
 
 	connect.Flags().StringVarP(&logLevel, "log_level", "l", "info", "Set the log level")
 	connect.Flags().StringVarP(&logPath, "log_path", "d", os.TempDir(), "Set the log directory")
+	connect.Flags().StringVar(&dnsForwarder, "dns-forwarder", "", "Run the built-in DNS forwarder on this loopback address, e.g. 127.0.0.153")
+	connect.Flags().BoolVar(&policyRouting, "policy-routing", false, "Put the VPN routes in a dedicated table selected by ip rules, Linux only")
+	connect.Flags().BoolVar(&killSwitch, "kill-switch", false, "Block all traffic outside the VPN until disconnect, Linux only")
+	connect.Flags().BoolVar(&killSwitchLAN, "kill-switch-lan", false, "Allow the local LAN while the kill switch is on")
 }
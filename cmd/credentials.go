@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/apieasy/gson"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+	"sslcon/base"
+)
+
+var (
+	withTOTP       bool
+	withPassphrase bool
+)
+
+var credentials = &cobra.Command{
+	Use:   "credentials",
+	Short: "Manage the credentials saved for the connection profiles",
+}
+
+var credentialsList = &cobra.Command{
+	Use:   "list",
+	Short: "List the profiles with saved credentials",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := gson.NewArray()
+		err := rpcCall("credential.list", nil, result)
+		if err != nil {
+			printError(err)
+		} else {
+			result.Print()
+		}
+	},
+}
+
+var credentialsSet = &cobra.Command{
+	Use:   "set <profile>",
+	Short: "Save the password, and optionally a TOTP secret, of a profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		params := make(map[string]string)
+		params["profile"] = args[0]
+		var err error
+		if params["password"], err = readSecret("Enter your password:"); err != nil {
+			fmt.Println("Error reading password:", err)
+			return
+		}
+		if withTOTP {
+			if params["totp_secret"], err = readSecret("Enter the TOTP secret:"); err != nil {
+				fmt.Println("Error reading TOTP secret:", err)
+				return
+			}
+		}
+		if withPassphrase {
+			if params["passphrase"], err = readSecret("Enter a passphrase:"); err != nil {
+				fmt.Println("Error reading passphrase:", err)
+				return
+			}
+			confirm, err := readSecret("Confirm the passphrase:")
+			if err != nil || confirm != params["passphrase"] {
+				fmt.Println("Passphrases do not match")
+				return
+			}
+		}
+		err = rpcCall("credential.set", params, nil)
+		if err != nil {
+			printError(err)
+		}
+	},
+}
+
+var credentialsClear = &cobra.Command{
+	Use:   "clear <profile>",
+	Short: "Delete the saved credentials of a profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := rpcCall("credential.clear", map[string]string{"profile": args[0]}, nil)
+		if err != nil {
+			printError(err)
+		}
+	},
+}
+
+// savedCredential 未保存凭据时返回 nil
+func savedCredential(profile string) *base.CredentialInfo {
+	var infos []base.CredentialInfo
+	if rpcCall("credential.list", nil, &infos) != nil {
+		return nil
+	}
+	for i := range infos {
+		if infos[i].Profile == profile {
+			return &infos[i]
+		}
+	}
+	return nil
+}
+
+func readSecret(prompt string) (string, error) {
+	fmt.Print(prompt)
+	b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(b), err
+}
+
+func init() {
+	rootCmd.AddCommand(credentials)
+	credentials.AddCommand(credentialsList, credentialsSet, credentialsClear)
+
+	credentialsSet.Flags().BoolVar(&withTOTP, "totp", false, "Also save a TOTP secret for the second login step")
+	credentialsSet.Flags().BoolVar(&withPassphrase, "passphrase", false, "Protect the credentials with a passphrase asked at every connect")
+}
@@ -1,12 +1,8 @@
 package cmd
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/apieasy/gson"
 	"github.com/spf13/cobra"
-	"sslcon/rpc"
 )
 
 var disconnect = &cobra.Command{
@@ -14,10 +10,9 @@ var disconnect = &cobra.Command{
 	Short: "Disconnect from the VPN server",
 	Run: func(cmd *cobra.Command, args []string) {
 		result := gson.New()
-		err := rpcCall("disconnect", nil, result, rpc.DISCONNECT)
+		err := rpcCall("disconnect", nil, result)
 		if err != nil {
-			after, _ := strings.CutPrefix(err.Error(), "jsonrpc2: code 1 message: ")
-			fmt.Println(after)
+			printError(err)
 		} else {
 			result.Print()
 		}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/apieasy/gson"
+	"github.com/spf13/cobra"
+)
+
+var groups = &cobra.Command{
+	Use:   "groups",
+	Short: "List the user groups offered by the VPN server without logging in",
+	Run: func(cmd *cobra.Command, args []string) {
+		if host == "" {
+			cmd.Help()
+			return
+		}
+		params := make(map[string]string)
+		params["host"] = host
+		params["secret"] = secret
+
+		result := gson.New()
+		err := rpcCall("groups", params, result)
+		if err != nil {
+			printError(err)
+		} else {
+			result.Print()
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(groups)
+
+	groups.Flags().StringVarP(&host, "server", "s", "", "VPN server")
+	groups.Flags().StringVarP(&secret, "key", "k", "", "Secret key")
+}
@@ -2,27 +2,96 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
 
 	"github.com/gorilla/websocket"
 	"github.com/sourcegraph/jsonrpc2"
 	ws "github.com/sourcegraph/jsonrpc2/websocket"
+	"sslcon/base"
+	"sslcon/rpc"
 )
 
-// type handler struct{}
-//
-// func (_ *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {}
-//
-// var rpcHandler = handler{}
+// handler 处理 vpnagent 推送的通知，notify 为 nil 时忽略
+type handler struct {
+	notify func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request)
+}
+
+func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Notif && h.notify != nil {
+		h.notify(ctx, conn, req)
+	}
+}
+
+var rpcHandler = handler{}
+
+func rpcCall(method string, params interface{}, result interface{}) error {
+	return rpcCallWith(&rpcHandler, method, params, result)
+}
 
-func rpcCall(method string, params interface{}, result interface{}, id uint64) error {
-	conn, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:6210/rpc", nil)
+// rpcCallWith 在调用返回之前通过 h 处理通知，h 中不能同步调用 conn.Call
+func rpcCallWith(h *handler, method string, params interface{}, result interface{}) error {
+	jsonStream, err := dialAgent()
 	if err != nil {
 		return err
 	}
-	jsonStream := ws.NewObjectStream(conn)
 	ctx := context.Background()
-	rpcConn := jsonrpc2.NewConn(ctx, jsonStream, nil)
+	rpcConn := jsonrpc2.NewConn(ctx, jsonStream, h)
 	defer rpcConn.Close()
 
-	return rpcConn.Call(ctx, method, params, result, jsonrpc2.PickID(jsonrpc2.ID{Num: id}))
+	return rpcConn.Call(ctx, method, params, result)
+}
+
+// printError rpc 错误只显示错误信息，错误类型见 data
+func printError(err error) {
+	var jError *jsonrpc2.Error
+	if errors.As(err, &jError) {
+		fmt.Println(jError.Message)
+		return
+	}
+	fmt.Println(err)
+}
+
+// dialAgent 优先使用 Unix socket，不需要读取 token
+func dialAgent() (jsonrpc2.ObjectStream, error) {
+	_ = base.LoadAgentConfig()
+	if runtime.GOOS == "linux" && base.AgentCfg.RPCSocket != "" {
+		conn, err := net.Dial("unix", base.AgentCfg.RPCSocket)
+		if err == nil {
+			return jsonrpc2.NewPlainObjectStream(conn), nil
+		}
+	}
+
+	// 需要 root 或者 token 文件所属组的成员才能读取
+	token, err := rpc.ReadToken()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set(rpc.TokenHeader, token)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+rpcAddr()+"/rpc?api=2", header)
+	if err != nil {
+		return nil, err
+	}
+	return ws.NewObjectStream(conn), nil
+}
+
+// rpcAddr 使用 vpnagent 配置的第一个监听地址，监听所有地址时连接本地回环地址
+func rpcAddr() string {
+	addr := "127.0.0.1:6210"
+	if len(base.AgentCfg.RPCAddr) > 0 {
+		addr = base.AgentCfg.RPCAddr[0]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
 }
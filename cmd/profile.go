@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/apieasy/gson"
+	"github.com/sourcegraph/jsonrpc2"
+	"github.com/spf13/cobra"
+	"sslcon/base"
+)
+
+var (
+	saved   = base.ConnProfile{}
+	trusted = base.TrustedNetwork{}
+)
+
+var profile = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage the connection profiles stored by the agent",
+}
+
+var profileList = &cobra.Command{
+	Use:   "list",
+	Short: "List the connection profiles",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := gson.NewArray()
+		err := rpcCall("profile.list", nil, result)
+		if err != nil {
+			printError(err)
+		} else {
+			result.Print()
+		}
+	},
+}
+
+var profileSave = &cobra.Command{
+	Use:   "save <name>",
+	Short: "Create or replace a connection profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		saved.Name = args[0]
+		if len(trusted.DNSDomains) > 0 || len(trusted.DNSServers) > 0 || trusted.URL != "" {
+			saved.TrustedNetwork = &trusted
+		}
+		result := gson.New()
+		err := rpcCall("profile.create", &saved, result)
+		var jError *jsonrpc2.Error
+		if errors.As(err, &jError) && jError.Code == int64(base.ErrConflict) {
+			// 已存在则更新
+			err = rpcCall("profile.update", &saved, result)
+		}
+		if err != nil {
+			printError(err)
+		} else {
+			result.Print()
+		}
+	},
+}
+
+var profileDelete = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a connection profile",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := rpcCall("profile.delete", map[string]string{"name": args[0]}, nil)
+		if err != nil {
+			printError(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(profile)
+	profile.AddCommand(profileList, profileSave, profileDelete)
+
+	flags := profileSave.Flags()
+	flags.StringVarP(&saved.Host, "server", "s", "", "VPN server")
+	flags.StringVarP(&saved.Username, "username", "u", "", "User name")
+	flags.StringVarP(&saved.Group, "group", "g", "", "User group")
+	flags.StringVarP(&saved.SecretKey, "key", "k", "", "Secret key")
+	flags.StringVar(&saved.AuthMethod, "auth", "", "Authentication method, password or certificate")
+	flags.StringVar(&saved.CertFile, "cert", "", "Client certificate file")
+	flags.StringVar(&saved.KeyFile, "cert-key", "", "Client private key file")
+	flags.StringVar(&saved.CAFile, "ca", "", "CA certificate file used to verify the server")
+	flags.StringSliceVar(&saved.Pins, "pin", nil, "SHA-256 fingerprint of the server certificate, see sslcon groups")
+	flags.StringSliceVar(&saved.Overrides.IncludeRoutes, "include-route", nil, "Route to send through the VPN")
+	flags.StringSliceVar(&saved.Overrides.ExcludeRoutes, "exclude-route", nil, "Route to keep out of the VPN")
+	flags.StringSliceVar(&saved.Overrides.IncludeDomains, "include-domain", nil, "Domain to send through the VPN")
+	flags.StringSliceVar(&saved.Overrides.ExcludeDomains, "exclude-domain", nil, "Domain to keep out of the VPN")
+	flags.StringSliceVar(&saved.Overrides.DNSServers, "dns", nil, "DNS server to use instead of the pushed ones")
+	flags.StringSliceVar(&saved.Overrides.SearchDomains, "search-domain", nil, "DNS search domain")
+	flags.BoolVar(&saved.Overrides.NoDefaultRoute, "no-default-route", false, "Ignore the default route pushed by the server")
+	flags.BoolVar(&saved.Overrides.LocalLAN, "local-lan", false, "Keep the local LAN out of the VPN in full tunnel mode")
+	flags.BoolVar(&saved.Overrides.LocalLANPrivate, "local-lan-private", false, "Also keep the RFC1918 private networks out of the VPN")
+	flags.StringSliceVar(&trusted.DNSDomains, "trusted-domain", nil, "DNS domain of the trusted network")
+	flags.StringSliceVar(&trusted.DNSServers, "trusted-dns", nil, "DNS server of the trusted network")
+	flags.StringVar(&trusted.URL, "trusted-url", "", "HTTPS URL only reachable from the trusted network")
+	flags.StringVar(&trusted.CertHash, "trusted-cert-hash", "", "SHA-256 fingerprint of the trusted URL certificate")
+	flags.StringVar(&trusted.TrustedPolicy, "trusted-policy", "", "Action on a trusted network, disconnect or none")
+	flags.StringVar(&trusted.UntrustedPolicy, "untrusted-policy", "", "Action on an untrusted network, connect or none")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"golang.org/x/crypto/ssh/terminal"
+	"sslcon/auth"
+	"sslcon/rpc"
+	"sslcon/session"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptUser 连接过程中 vpnagent 需要用户确认或输入时，在终端提示用户并回复
+func promptUser(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Method != rpc.EventInputRequired || req.Params == nil {
+		return
+	}
+	p := new(session.Prompt)
+	if err := json.Unmarshal(*req.Params, p); err != nil {
+		return
+	}
+	// 不能阻塞读取 vpnagent 的响应
+	go func() {
+		reply := &session.PromptReply{ID: p.ID}
+		switch p.Kind {
+		case session.BannerPreLogin, session.BannerPostLogin:
+			fmt.Println()
+			fmt.Println(p.Message)
+			fmt.Println()
+			reply.Accept = confirm("Accept the banner? [y/N]: ")
+		case auth.PromptPasswordChange:
+			fmt.Println()
+			fmt.Println(p.Message)
+			reply.Values = make(map[string]string)
+			reply.Accept = true
+			for _, f := range p.Fields {
+				value, err := readField(f)
+				if err != nil {
+					fmt.Println("Error reading input:", err)
+					reply.Accept = false
+					break
+				}
+				reply.Values[f.Name] = value
+			}
+		default:
+			fmt.Println("unsupported input:", p.Kind)
+		}
+		if err := conn.Call(ctx, "input", reply, nil); err != nil {
+			printError(err)
+		}
+	}()
+}
+
+// readField 密码等字段不回显
+func readField(f session.PromptField) (string, error) {
+	label := f.Label
+	if label == "" {
+		label = f.Name + ":"
+	}
+	fmt.Print(label, " ")
+	if f.Secret {
+		value, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(value), err
+	}
+	value, err := stdin.ReadString('\n')
+	return strings.TrimSpace(value), err
+}
+
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -1,12 +1,8 @@
 package cmd
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/apieasy/gson"
 	"github.com/spf13/cobra"
-	"sslcon/rpc"
 )
 
 var status = &cobra.Command{
@@ -14,10 +10,9 @@ var status = &cobra.Command{
 	Short: "Get VPN connection information",
 	Run: func(cmd *cobra.Command, args []string) {
 		result := gson.New()
-		err := rpcCall("status", nil, result, rpc.STATUS)
+		err := rpcCall("status", nil, result)
 		if err != nil {
-			after, _ := strings.CutPrefix(err.Error(), "jsonrpc2: code 1 message: ")
-			fmt.Println(after)
+			printError(err)
 		} else {
 			result.Print()
 		}
@@ -5,6 +5,8 @@ go 1.26.2
 require (
 	github.com/apieasy/gson v0.2.3
 	github.com/elastic/go-sysinfo v1.15.4
+	github.com/godbus/dbus/v5 v5.2.2
+	github.com/google/nftables v0.3.0
 	github.com/gopacket/gopacket v1.5.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/jackpal/gateway v1.2.0
@@ -23,7 +25,10 @@ require (
 
 require (
 	github.com/elastic/go-windows v1.0.2 // indirect
+	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/mdlayher/netlink v1.7.3-0.20250113171957-fbb4dce95f42 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
 	github.com/pion/logging v0.2.4 // indirect
 	github.com/pion/transport/v4 v4.0.1 // indirect
 	github.com/prometheus/procfs v0.20.1 // indirect
@@ -33,6 +38,7 @@ require (
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 	github.com/vishvananda/netns v0.0.5 // indirect
+	golang.org/x/sync v0.20.0 // indirect
 	golang.org/x/term v0.42.0 // indirect
 	howett.net/plist v1.0.1 // indirect
-)
\ No newline at end of file
+)
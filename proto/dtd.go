@@ -1,6 +1,10 @@
 package proto
 
-import "encoding/xml"
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+)
 
 // DTD 基于 XML 的客户端、服务端请求和响应数据结构
 // https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-03#appendix-C.1
@@ -21,6 +25,7 @@ type DTD struct {
 }
 
 type auth struct {
+	Id       string    `xml:"id,attr"`
 	Username string    `xml:"username"`
 	Password string    `xml:"password"`
 	Message  string    `xml:"message"`
@@ -30,8 +35,76 @@ type auth struct {
 }
 
 type form struct {
-	Action string   `xml:"action,attr"`
-	Groups []string `xml:"select>option"`
+	Action  string   `xml:"action,attr"`
+	Options []option `xml:"select>option"`
+	Inputs  []Input  `xml:"input"`
+}
+
+// Input 表单中需要用户填写或原样提交的字段
+type Input struct {
+	Type  string `xml:"type,attr"`
+	Name  string `xml:"name,attr"`
+	Label string `xml:"label,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// IsNewPassword 如 new_password、new-password、newPassword
+func (i Input) IsNewPassword() bool {
+	name := strings.ToLower(i.Name)
+	return strings.Contains(name, "new") && strings.Contains(name, "pass")
+}
+
+// PasswordChange 密码过期时服务端要求修改密码，如 ASA 的 passwd_chg 或者包含新密码字段的表单
+func (a auth) PasswordChange() bool {
+	if a.Id == "passwd_chg" {
+		return true
+	}
+	for _, i := range a.Form.Inputs {
+		if i.IsNewPassword() {
+			return true
+		}
+	}
+	return false
+}
+
+// option ocserv 只有显示的名称，AnyConnect 服务端通过 value 指定组名
+type option struct {
+	Value string `xml:"value,attr"`
+	Label string `xml:",chardata"`
+}
+
+// Groups 用户组的值
+func (f form) Groups() []string {
+	groups := make([]string, 0, len(f.Options))
+	for _, o := range f.Options {
+		groups = append(groups, o.Name())
+	}
+	return groups
+}
+
+// Group 根据用户组的值或者显示的名称查找用户组的值
+func (f form) Group(group string) (string, bool) {
+	for _, o := range f.Options {
+		if o.Name() == group || o.Label == group {
+			return o.Name(), true
+		}
+	}
+	return "", false
+}
+
+func (o option) Name() string {
+	if o.Value != "" {
+		return o.Value
+	}
+	return o.Label
+}
+
+// MarshalJSON 前端只需要提交的组名和显示的名称
+func (o option) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name  string `json:"name"`
+		Label string `json:"label"`
+	}{o.Name(), strings.TrimSpace(o.Label)})
 }
 
 type authError struct {
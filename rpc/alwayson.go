@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.uber.org/atomic"
+	"sslcon/base"
+	"sslcon/session"
+)
+
+const (
+	alwaysOnMinBackoff = 2 * time.Second
+	alwaysOnMaxBackoff = 2 * time.Minute
+)
+
+var (
+	// alwaysOnWake 状态变化时唤醒，只保留一个信号
+	alwaysOnWake = make(chan struct{}, 1)
+	// alwaysOnPaused 被允许的前端主动断开或者服务停止时暂停，直到再次调用 connect
+	alwaysOnPaused atomic.Bool
+)
+
+// StartAlwaysOn vpnagent 启动时调用，使用 base.AgentCfg.AlwaysOn 指定的连接配置连接并一直保持，密码需要保存在凭据库中
+func StartAlwaysOn() {
+	name := base.AgentCfg.AlwaysOn
+	if name == "" {
+		return
+	}
+	if _, err := base.Profiles.Get(name); err != nil {
+		base.Error("always on:", err)
+		return
+	}
+	base.Info("always on:", name)
+	go alwaysOn(name)
+}
+
+// StopAlwaysOn 服务停止时调用，之后的断开不再重连
+func StopAlwaysOn() {
+	alwaysOnPaused.Store(true)
+}
+
+func alwaysOn(name string) {
+	params, _ := json.Marshal(map[string]string{"profile": name})
+	backoff := alwaysOnMinBackoff
+	// 隧道异常断开时先尝试使用 SessionToken 重连，失败再重新认证
+	canReconnect := false
+	for {
+		state := session.Sess.State.Current()
+		if alwaysOnPaused.Load() || tndTrusted.Load() {
+			canReconnect = false
+		} else if state == session.StateIdle || state == session.StateFailed {
+			var err error
+			if canReconnect && state == session.StateFailed {
+				err = reconnect(triggerAlwaysOn)
+				canReconnect = err == nil
+			} else {
+				err = connect(params)
+				canReconnect = err == nil
+			}
+			if err != nil {
+				base.Error("always on:", err)
+				time.Sleep(backoff)
+				backoff = min(backoff*2, alwaysOnMaxBackoff)
+				continue
+			}
+			backoff = alwaysOnMinBackoff
+		}
+		select {
+		case <-alwaysOnWake:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func wakeAlwaysOn() {
+	select {
+	case alwaysOnWake <- struct{}{}:
+	default:
+	}
+}
+
+// checkProfile always_on 使用的连接配置和凭据只有 admin 可以修改或删除，否则可以使自动连接失败
+func (h *handler) checkProfile(name string) error {
+	if base.AgentCfg.AlwaysOn == "" || name != base.AgentCfg.AlwaysOn || h.admin {
+		return nil
+	}
+	return base.Errorf(base.ErrPermissionDenied, "the always-on profile %s can only be changed by an administrator", name)
+}
+
+// checkDisconnect always_on 时只有 admin 可以断开，除非配置允许
+func (h *handler) checkDisconnect() error {
+	if base.AgentCfg.AlwaysOn == "" || h.admin || base.AgentCfg.AlwaysOnAllowDisconnect {
+		return nil
+	}
+	return base.Errorf(base.ErrPermissionDenied, "always-on connection can only be disconnected by an administrator")
+}
@@ -1,42 +1,56 @@
 package rpc
 
 import (
-	"strings"
+	"context"
+	"encoding/json"
+	"sync"
 
+	"go.uber.org/atomic"
 	"sslcon/auth"
+	"sslcon/base"
 	"sslcon/session"
 	"sslcon/utils/vpnc"
 	"sslcon/vpn"
 )
 
-// Connect 调用之前必须由前端填充 auth.Prof，建议填充 base.Interface
-func Connect() error {
-	if strings.Contains(auth.Prof.Host, ":") {
-		auth.Prof.HostWithPort = auth.Prof.Host
-	} else {
-		auth.Prof.HostWithPort = auth.Prof.Host + ":443"
-	}
+var (
+	cancelMux     sync.Mutex
+	connectCancel context.CancelFunc
+)
+
+// Connect 调用之前必须由前端填充 auth.Prof，建议填充 base.Interface，ctx 取消时中断连接过程
+func Connect(ctx context.Context) error {
+	auth.Prof.HostWithPort = auth.HostWithPort(auth.Prof.Host)
 	if !auth.Prof.Initialized {
 		err := vpnc.GetLocalInterface()
 		if err != nil {
 			return err
 		}
 	}
-	err := auth.InitAuth()
+	// 状态转换失败说明连接过程中被 disconnect 中断
+	err := session.Sess.State.Transition(session.StateAuthenticating, nil)
 	if err != nil {
 		return err
 	}
-	err = auth.PasswordAuth()
+	err = auth.InitAuth(ctx)
+	if err != nil {
+		return err
+	}
+	err = auth.PasswordAuth(ctx)
 	if err != nil {
 		return err
 	}
 
-	return SetupTunnel(false)
+	err = session.Sess.State.Transition(session.StateEstablishing, nil)
+	if err != nil {
+		return err
+	}
+	return SetupTunnel(ctx, false)
 }
 
 // SetupTunnel 操作系统长时间睡眠后再自动连接会失败，仅用于短时间断线自动重连
-func SetupTunnel(reconnect bool) error {
-	// 为适应复杂网络环境，必须能够感知网卡变化，建议由前端获取当前网络信息发送过来，而不是登陆前由 Go 处理
+func SetupTunnel(ctx context.Context, reconnect bool) error {
+	// 为适应复杂网络环境，必须能够感知网卡变化，Linux 上由 watchNetwork 处理，其它系统建议由前端获取当前网络信息发送过来
 	// 断网重连时网卡信息可能已经变化，所以建立隧道时重新获取网卡信息
 	if reconnect && !auth.Prof.Initialized {
 		err := vpnc.GetLocalInterface()
@@ -44,7 +58,13 @@ func SetupTunnel(reconnect bool) error {
 			return err
 		}
 	}
-	return vpn.SetupTunnel()
+	if reconnect {
+		err := auth.Redial(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return vpn.SetupTunnel(ctx)
 }
 
 // DisConnect 主动断开或者 ctrl+c，不包括网络或tun异常退出
@@ -55,3 +75,198 @@ func DisConnect() {
 		session.Sess.CSess.Close()
 	}
 }
+
+// connect 处理 connect 方法，只能在 Idle 或 Failed 状态下调用
+func connect(params json.RawMessage) error {
+	err := session.Sess.State.Transition(session.StateResolving, nil)
+	if err != nil {
+		return err
+	}
+	ctx := beginCancelable()
+	defer endCancelable()
+
+	err = applyParams(params)
+	if err == nil {
+		session.History.Begin(auth.Prof.Host, auth.Prof.Username, auth.Prof.Group, false)
+		err = Connect(ctx)
+	}
+	if err != nil {
+		DisConnect()
+		return finish(err)
+	}
+	connectedStr = "connected to " + auth.Prof.Host
+	disconnectedStr = "disconnected from " + auth.Prof.Host
+	return established()
+}
+
+// applyParams 指定 profile 时先使用连接配置和凭据库，参数中的其它字段如密码覆盖连接配置
+func applyParams(params json.RawMessage) error {
+	var p struct {
+		Profile    string `json:"profile"`
+		Passphrase string `json:"passphrase"`
+	}
+	err := json.Unmarshal(params, &p)
+	if err != nil {
+		return base.NewError(base.ErrInvalidParams, err)
+	}
+	cp := &base.ConnProfile{}
+	if p.Profile != "" {
+		cp, err = base.Profiles.Get(p.Profile)
+		if err != nil {
+			return err
+		}
+	}
+	auth.Prof.Apply(cp)
+	err = json.Unmarshal(params, auth.Prof)
+	if err != nil {
+		return base.NewError(base.ErrInvalidParams, err)
+	}
+	if auth.Prof.Host == "" {
+		return base.Errorf(base.ErrInvalidParams, "missing host")
+	}
+	if p.Profile != "" {
+		return applyCredential(p.Profile, p.Passphrase)
+	}
+	return nil
+}
+
+// applyCredential 参数中的密码优先，此时口令保护的凭据不要求口令
+func applyCredential(profile, passphrase string) error {
+	info, err := base.Vault.Info(profile)
+	if err != nil || info == nil {
+		return err
+	}
+	if auth.Prof.Password != "" && info.Passphrase && passphrase == "" {
+		return nil
+	}
+	// 参数可以覆盖服务器，必须使用实际连接的服务端解密
+	cred, err := base.Vault.Open(profile, auth.Prof.CredentialScope(), passphrase)
+	if err != nil {
+		if auth.Prof.Password != "" {
+			base.Warn("saved credential not used:", err)
+			return nil
+		}
+		return err
+	}
+	if auth.Prof.Password == "" {
+		auth.Prof.Password = cred.Password
+	}
+	auth.Prof.TOTPSecret = cred.TOTPSecret
+	auth.Prof.Passphrase = passphrase
+	return nil
+}
+
+// 重连的来源，sslcon_reconnects_total 的 trigger 标签
+const (
+	triggerRPC      = "rpc"
+	triggerAlwaysOn = "always_on"
+	triggerNetwork  = "network_change" // 本机地址变化后重建隧道
+)
+
+// reconnects 自 vpnagent 启动以来各来源的重连次数
+var reconnects = map[string]*atomic.Uint64{
+	triggerRPC:      atomic.NewUint64(0),
+	triggerAlwaysOn: atomic.NewUint64(0),
+	triggerNetwork:  atomic.NewUint64(0),
+}
+
+// reconnect 处理 reconnect 方法、always on 和网络变化的重连，复用上次认证得到的 SessionToken
+func reconnect(trigger string) error {
+	err := session.Sess.State.Transition(session.StateReconnecting, nil)
+	if err != nil {
+		return err
+	}
+	ctx := beginCancelable()
+	defer endCancelable()
+
+	reconnects[trigger].Inc()
+	session.History.Begin(auth.Prof.Host, auth.Prof.Username, auth.Prof.Group, true)
+	err = SetupTunnel(ctx, true)
+	if err != nil {
+		DisConnect()
+		return finish(err)
+	}
+	return established()
+}
+
+// disconnect 处理 disconnect 方法，连接过程中调用时由连接过程自行退出
+func disconnect() error {
+	state := session.Sess.State.Current()
+	if state != session.StateConnected && !state.InProgress() {
+		return base.Errorf(base.ErrNotConnected, "not connected")
+	}
+	err := session.Sess.State.Transition(session.StateDisconnecting, nil)
+	if err != nil {
+		return err
+	}
+	if state == session.StateConnected {
+		// monitor 负责转换到 Idle
+		DisConnect()
+	} else {
+		cancelConnect()
+	}
+	return nil
+}
+
+// abort 处理 abort 方法，中断正在进行的 connect 或 reconnect，已连接时应使用 disconnect
+func abort() error {
+	if !session.Sess.State.Current().InProgress() {
+		return base.Errorf(base.ErrNotConnected, "no connection in progress")
+	}
+	err := session.Sess.State.Transition(session.StateDisconnecting, nil)
+	if err != nil {
+		return err
+	}
+	cancelConnect()
+	return nil
+}
+
+// beginCancelable 连接过程只有一个，由状态机保证
+func beginCancelable() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelMux.Lock()
+	connectCancel = cancel
+	cancelMux.Unlock()
+	return ctx
+}
+
+func endCancelable() {
+	cancelMux.Lock()
+	defer cancelMux.Unlock()
+	if connectCancel != nil {
+		connectCancel()
+		connectCancel = nil
+	}
+}
+
+func cancelConnect() {
+	cancelMux.Lock()
+	defer cancelMux.Unlock()
+	if connectCancel != nil {
+		connectCancel()
+	}
+}
+
+// established 隧道已经建立，如果期间被 disconnect 中断则立即断开
+func established() error {
+	err := session.Sess.State.Transition(session.StateConnected, nil)
+	if err != nil {
+		DisConnect()
+		return finish(err)
+	}
+	session.History.Connected()
+	go monitor()
+	return nil
+}
+
+// finish 连接失败，被 disconnect 中断则回到 Idle，否则为 Failed
+func finish(err error) error {
+	if session.Sess.State.TransitionFrom([]session.State{session.StateDisconnecting}, session.StateIdle, nil) == nil {
+		err = base.Errorf(base.ErrCancelled, "connection cancelled")
+		session.History.End(err)
+		return err
+	}
+	_ = session.Sess.State.Transition(session.StateFailed, err)
+	session.History.End(err)
+	return err
+}
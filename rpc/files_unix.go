@@ -0,0 +1,68 @@
+//go:build !windows
+
+package rpc
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"sslcon/base"
+)
+
+// readableBy 按照权限位判断 uid 和 gids 能否读取 path，上级目录需要执行权限，不考虑 ACL
+func readableBy(path string, uid uint32, gids []uint32) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		if !permitted(dir, uid, gids, 01) {
+			return false
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return permitted(path, uid, gids, 04)
+}
+
+func permitted(path string, uid uint32, gids []uint32, bit os.FileMode) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	mode := fi.Mode().Perm()
+	switch {
+	case st.Uid == uid:
+		return mode&(bit<<6) != 0
+	case slices.Contains(gids, st.Gid):
+		return mode&(bit<<3) != 0
+	}
+	return mode&bit != 0
+}
+
+// tokenFileCheck WebSocket 前端持有 token，只能确定是 base.AgentCfg.TokenGroup 组成员，文件必须对该组或者所有用户可读
+func tokenFileCheck() func(string) error {
+	var gids []uint32
+	if base.AgentCfg.TokenGroup != "" {
+		if g, err := user.LookupGroup(base.AgentCfg.TokenGroup); err == nil {
+			gid, _ := strconv.Atoi(g.Gid)
+			gids = append(gids, uint32(gid))
+		}
+	}
+	return func(path string) error {
+		// 不存在的 uid，只按照组和其它用户的权限判断
+		if !readableBy(path, ^uint32(0), gids) {
+			return base.Errorf(base.ErrPermissionDenied, "%s is not readable by the %s group", path, base.AgentCfg.TokenGroup)
+		}
+		return nil
+	}
+}
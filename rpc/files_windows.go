@@ -0,0 +1,6 @@
+package rpc
+
+// tokenFileCheck Windows 上只有管理员可以读取 token，不限制文件
+func tokenFileCheck() func(string) error {
+	return nil
+}
@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"sslcon/base"
+	"sslcon/session"
+)
+
+// setupMetrics 按照 base.AgentCfg.MetricsAddr 启动 Prometheus 监听，地址为空则不启用，不能通过 rpc 修改
+func setupMetrics() {
+	addr := base.AgentCfg.MetricsAddr
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metrics)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		base.Info("metrics listen on", addr)
+		// 与 rpc 服务不同，监控端口无法启动不影响 VPN 使用
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			base.Error("metrics:", err)
+		}
+	}()
+}
+
+// metrics Prometheus text format 0.0.4
+func metrics(resp http.ResponseWriter, _ *http.Request) {
+	w := &metricWriter{}
+
+	for _, trigger := range []string{triggerRPC, triggerAlwaysOn, triggerNetwork} {
+		w.write("sslcon_reconnects_total", "counter", "Number of tunnel reconnect attempts since the agent started.",
+			float64(reconnects[trigger].Load()), `trigger="`+trigger+`"`)
+	}
+	current := session.Sess.State.Current()
+	for s := session.StateIdle; s <= session.StateFailed; s++ {
+		w.write("sslcon_state", "gauge", "Current connection state, 1 for the current state and 0 for the others.",
+			boolToFloat(s == current), `state="`+s.String()+`"`)
+	}
+
+	cSess := session.Sess.CSess
+	if cSess == nil {
+		w.write("sslcon_connected", "gauge", "Whether the VPN tunnel is established.", 0)
+		w.write("sslcon_dtls_connected", "gauge", "Whether the DTLS channel is established.", 0)
+		w.flush(resp)
+		return
+	}
+	server := `server="` + escapeLabel(cSess.Hostname) + `"`
+
+	w.write("sslcon_connected", "gauge", "Whether the VPN tunnel is established.", 1, server)
+	w.write("sslcon_dtls_connected", "gauge", "Whether the DTLS channel is established.", boolToFloat(cSess.DtlsConnected.Load()), server)
+	w.write("sslcon_connected_seconds", "gauge", "Seconds since the VPN tunnel was established.",
+		time.Since(cSess.ConnectedAt).Seconds(), server)
+	if remaining := cSess.SessionRemaining(); remaining >= 0 {
+		w.write("sslcon_session_remaining_seconds", "gauge", "Seconds until the server terminates the session.",
+			remaining.Seconds(), server)
+	}
+
+	st := cSess.GetStat()
+	w.write("sslcon_bytes_sent_total", "counter", "Bytes sent to the server on all channels.", float64(st.BytesSent.Load()), server)
+	w.write("sslcon_bytes_received_total", "counter", "Bytes received from the server on all channels.", float64(st.BytesReceived.Load()), server)
+
+	channels := []struct {
+		name string
+		c    *session.ChannelStat
+	}{{"tls", st.TLS}, {"dtls", st.DTLS}}
+	channelMetrics := []struct {
+		name, typ, help string
+		value           func(c *session.ChannelStat) float64
+	}{
+		{"sslcon_channel_bytes_sent_total", "counter", "Bytes sent to the server per channel.",
+			func(c *session.ChannelStat) float64 { return float64(c.BytesSent.Load()) }},
+		{"sslcon_channel_bytes_received_total", "counter", "Bytes received from the server per channel.",
+			func(c *session.ChannelStat) float64 { return float64(c.BytesReceived.Load()) }},
+		{"sslcon_channel_packets_sent_total", "counter", "Packets sent to the server per channel.",
+			func(c *session.ChannelStat) float64 { return float64(c.PacketsSent.Load()) }},
+		{"sslcon_channel_packets_received_total", "counter", "Packets received from the server per channel.",
+			func(c *session.ChannelStat) float64 { return float64(c.PacketsReceived.Load()) }},
+		{"sslcon_channel_compressed_received_total", "counter", "Compressed data packets received per channel.",
+			func(c *session.ChannelStat) float64 { return float64(c.CompressedReceived.Load()) }},
+		{"sslcon_channel_discarded_total", "counter", "Packets received but discarded per channel, such as compressed data.",
+			func(c *session.ChannelStat) float64 { return float64(c.Discarded.Load()) }},
+		{"sslcon_channel_dpd_rtt_seconds", "gauge", "Round trip time of the last dead peer detection.",
+			func(c *session.ChannelStat) float64 { return c.DpdRTT.Load().Seconds() }},
+	}
+	for _, m := range channelMetrics {
+		for _, ch := range channels {
+			w.write(m.name, m.typ, m.help, m.value(ch.c), server, `channel="`+ch.name+`"`)
+		}
+	}
+
+	queues := []struct {
+		name string
+		q    *session.QueueStat
+	}{{"tls", st.TLS.Queue}, {"dtls", st.DTLS.Queue}, {"in", st.PayloadIn}}
+	queueMetrics := []struct {
+		name, typ, help string
+		value           func(q *session.QueueStat) float64
+	}{
+		{"sslcon_queue_capacity", "gauge", "Capacity of the payload queue.",
+			func(q *session.QueueStat) float64 { return float64(q.Capacity) }},
+		{"sslcon_queue_depth", "gauge", "Current depth of the payload queue.",
+			func(q *session.QueueStat) float64 { return float64(q.Depth.Load()) }},
+		{"sslcon_queue_high_water", "gauge", "Highest depth of the payload queue.",
+			func(q *session.QueueStat) float64 { return float64(q.HighWater.Load()) }},
+		{"sslcon_queue_drops_total", "counter", "Packets dropped by the payload queue.",
+			func(q *session.QueueStat) float64 { return float64(q.Drops.Load()) }},
+	}
+	for _, m := range queueMetrics {
+		for _, qu := range queues {
+			w.write(m.name, m.typ, m.help, m.value(qu.q), server, `queue="`+qu.name+`"`)
+		}
+	}
+
+	w.flush(resp)
+}
+
+// metricWriter 同名指标的 HELP、TYPE 只输出一次，且同名指标必须连续输出
+type metricWriter struct {
+	buf     bytes.Buffer
+	written map[string]bool
+}
+
+func (w *metricWriter) write(name, typ, help string, value float64, labels ...string) {
+	if w.written == nil {
+		w.written = make(map[string]bool)
+	}
+	if !w.written[name] {
+		fmt.Fprintf(&w.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		w.written[name] = true
+	}
+	if len(labels) > 0 {
+		fmt.Fprintf(&w.buf, "%s{%s} %g\n", name, strings.Join(labels, ","), value)
+	} else {
+		fmt.Fprintf(&w.buf, "%s %g\n", name, value)
+	}
+}
+
+func (w *metricWriter) flush(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = resp.Write(w.buf.Bytes())
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
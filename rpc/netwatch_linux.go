@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"sslcon/auth"
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils/vpnc"
+)
+
+// netwatchDebounce 切换网络时地址和路由分多次变化，等待稳定后再处理
+const netwatchDebounce = 2 * time.Second
+
+// watchNetwork 默认网关变化时重新指定绕过 VPN 的路由，本机地址变化时重建隧道，前端推送 interface 时不处理
+func watchNetwork() {
+	changes := make(chan struct{}, 1)
+	err := vpnc.WatchNetwork(nil, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		base.Error("network watcher:", err)
+		return
+	}
+	go func() {
+		for range changes {
+			time.Sleep(netwatchDebounce)
+			select {
+			case <-changes:
+			default:
+			}
+			cSess := session.Sess.CSess
+			if auth.Prof.Initialized || cSess == nil || session.Sess.State.Current() != session.StateConnected {
+				continue
+			}
+			reconnectNeeded, err := vpnc.RepointRoutes(cSess)
+			if err != nil {
+				base.Warn("network changed:", err)
+				continue
+			}
+			if reconnectNeeded {
+				rebuildTunnel(cSess)
+			}
+		}
+	}()
+}
+
+// rebuildTunnel 关闭旧隧道，等待 tun 网卡关闭即旧路由已经清除，然后使用 SessionToken 重连
+func rebuildTunnel(cSess *session.ConnSession) {
+	tunName := cSess.TunName
+	cSess.Close()
+	// monitor 转换到 Failed 之后才能重连
+	for i := 0; i < 50; i++ {
+		_, err := netlink.LinkByName(tunName)
+		if err != nil && session.Sess.State.Current() != session.StateConnected {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// always on 可能已经开始重连
+	if session.Sess.State.Current() != session.StateFailed {
+		return
+	}
+	if err := reconnect(triggerNetwork); err != nil {
+		base.Error("network changed, reconnect failed:", err)
+	}
+}
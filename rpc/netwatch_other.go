@@ -0,0 +1,6 @@
+//go:build !linux
+
+package rpc
+
+// watchNetwork 目前只在 Linux 上检测网络变化，其它系统由前端推送 interface 后调用 reconnect
+func watchNetwork() {}
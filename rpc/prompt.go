@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"sslcon/base"
+	"sslcon/session"
+)
+
+var (
+	promptMux sync.Mutex
+	promptSeq uint64
+	pending   *pendingPrompt
+)
+
+type pendingPrompt struct {
+	prompt *session.Prompt
+	reply  chan *session.PromptReply
+}
+
+// prompt 实现 session.Sess.Prompt，进入 AwaitingInput 状态并通知前端，等待前端调用 input 方法；
+// 没有可以回复的前端时立即失败，如 always-on 或者可信网络检测发起的连接
+func prompt(ctx context.Context, p *session.Prompt) (*session.PromptReply, error) {
+	if !interactiveClient() {
+		return nil, session.ErrNoFrontend
+	}
+	prev := session.Sess.State.Current()
+	err := session.Sess.State.Transition(session.StateAwaitingInput, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	promptMux.Lock()
+	promptSeq++
+	p.ID = promptSeq
+	pp := &pendingPrompt{prompt: p, reply: make(chan *session.PromptReply, 1)}
+	pending = pp
+	promptMux.Unlock()
+	defer func() {
+		promptMux.Lock()
+		if pending == pp {
+			pending = nil
+		}
+		promptMux.Unlock()
+	}()
+
+	notify(EventInputRequired, p)
+
+	if base.Cfg.InputTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(base.Cfg.InputTimeout)*time.Second)
+		defer cancel()
+	}
+	var reply *session.PromptReply
+	select {
+	case reply = <-pp.reply:
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, base.Errorf(base.ErrTimeout, "no input within %d seconds", base.Cfg.InputTimeout)
+		}
+		return nil, ctx.Err()
+	}
+	// 被 disconnect 中断时状态已经是 Disconnecting，转换失败
+	err = session.Sess.State.Transition(prev, nil)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// interactiveClient 接收通知并且可以调用 input 方法的前端，兼容模式的前端不处理通知
+func interactiveClient() bool {
+	for _, c := range clients() {
+		if c.privileged && !c.legacy {
+			return true
+		}
+	}
+	return false
+}
+
+// currentPrompt 后连接的前端通过 prompt 方法获取正在等待的请求
+func currentPrompt() *session.Prompt {
+	promptMux.Lock()
+	defer promptMux.Unlock()
+	if pending == nil {
+		return nil
+	}
+	return pending.prompt
+}
+
+// input 处理 input 方法，只有第一个回复生效
+func input(reply *session.PromptReply) error {
+	promptMux.Lock()
+	defer promptMux.Unlock()
+	if pending == nil || pending.prompt.ID != reply.ID {
+		return base.Errorf(base.ErrInvalidParams, "no pending input with id %d", reply.ID)
+	}
+	pending.reply <- reply
+	pending = nil
+	return nil
+}
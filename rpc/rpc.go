@@ -3,9 +3,13 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"runtime"
 	"runtime/debug"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/sourcegraph/jsonrpc2"
@@ -13,8 +17,10 @@ import (
 	"sslcon/auth"
 	"sslcon/base"
 	"sslcon/session"
+	"sslcon/utils/vpnc"
 )
 
+// 旧版前端通过 ID 区分方法，并依赖 monitor 向 DISCONNECT、ABORT 发送的伪响应，兼容模式下仍然支持
 const (
 	STATUS = iota
 	CONFIG
@@ -26,28 +32,93 @@ const (
 	STAT
 )
 
+var legacyMethods = map[uint64]string{
+	STATUS:     "status",
+	CONFIG:     "config",
+	CONNECT:    "connect",
+	DISCONNECT: "disconnect",
+	RECONNECT:  "reconnect",
+	INTERFACE:  "interface",
+	STAT:       "stat",
+}
+
+// 服务端主动推送的通知
+const (
+	EventStateChanged  = "event.state_changed"
+	EventDisconnected  = "event.disconnected"
+	EventAborted       = "event.aborted"
+	EventInputRequired = "event.input_required"
+)
+
 var (
-	Clients         []*jsonrpc2.Conn
-	rpcHandler      = handler{}
+	Clients         []*client
+	clientsMux      sync.Mutex
 	connectedStr    string
 	disconnectedStr string
 )
 
-type handler struct{}
+// handler 每个客户端连接一个，privileged 表示可以修改配置和连接状态，admin 仅限通过 Unix socket 连接的 root
+type handler struct {
+	privileged bool
+	admin      bool
+	legacy     bool
+	// checkFile 检查前端指定的文件前端自己能否读取，vpnagent 以 root 运行，为空则不限制
+	checkFile func(path string) error
+}
+
+type client struct {
+	conn       *jsonrpc2.Conn
+	legacy     bool
+	privileged bool
+}
 
 func Setup() {
-	go func() {
-		http.HandleFunc("/rpc", rpc)
-		// 无法启动则退出服务或应用，监听本地不需要有效物理网卡
-		base.Fatal(http.ListenAndServe(":6210", nil))
-	}()
+	// 上次异常退出时遗留的路由和 DNS 修改，断网保护由 disconnect 解除
+	if entries, err := vpnc.Cleanup(true); len(entries) > 0 {
+		base.Warn("rolled back", len(entries), "leftover changes:", err)
+	}
+	err := initToken()
+	if err != nil {
+		// 没有 token 任何客户端都无法调用
+		base.Fatal("rpc token:", err)
+	}
+	// 无法启动则退出服务或应用，监听本地不需要有效物理网卡
+	unixOK := setupUnix()
+	if len(base.AgentCfg.RPCAddr) > 0 {
+		listeners, err := listenAll(base.AgentCfg.RPCAddr)
+		if err != nil {
+			base.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/rpc", rpc)
+		for _, l := range listeners {
+			go func(l net.Listener) {
+				base.Fatal(http.Serve(l, mux))
+			}(l)
+		}
+	} else if !unixOK {
+		base.Fatal("no rpc transport available")
+	}
+	setupMetrics()
+	session.Sess.State.OnChange = func(info session.StateInfo) {
+		notify(EventStateChanged, info)
+		wakeAlwaysOn()
+	}
+	session.Sess.Prompt = prompt
+	session.History.Load()
+	watchNetwork()
 }
 
 func rpc(resp http.ResponseWriter, req *http.Request) {
+	if !checkToken(req) {
+		base.Warn("rpc: invalid token from", req.RemoteAddr)
+		http.Error(resp, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	// 选择 Protocol，不能回应携带 token 的子协议
 	up := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:  checkOrigin,
+		Subprotocols: []string{Protocol},
 	}
 	conn, err := up.Upgrade(resp, req, nil)
 	if err != nil {
@@ -56,44 +127,79 @@ func rpc(resp http.ResponseWriter, req *http.Request) {
 	}
 	defer conn.Close()
 
-	jsonStream := ws.NewObjectStream(conn)
+	// 持有 token 即为 root 或者 token 文件所属组的成员，新版前端通过 api=2 关闭兼容模式
+	legacy := base.AgentCfg.LegacyRPC && req.URL.Query().Get("api") != "2"
+	serveConn(req.Context(), ws.NewObjectStream(conn), &handler{privileged: true, legacy: legacy, checkFile: tokenFileCheck()})
+}
+
+// serveConn 阻塞直到客户端断开，WebSocket 和 Unix socket 共用
+func serveConn(ctx context.Context, stream jsonrpc2.ObjectStream, h *handler) {
 	// 此时 base.GetBaseLogger() 仍然是 Stdout，当前使用的 rpc 库无法在连接成功后修改 logger
-	rpcConn := jsonrpc2.NewConn(req.Context(), jsonStream, &rpcHandler, jsonrpc2.SetLogger(base.GetBaseLogger()))
-	Clients = append(Clients, rpcConn)
+	// AsyncHandler 使每个请求在独立协程处理，客户端可以在 connect 过程中查询状态
+	rpcConn := jsonrpc2.NewConn(ctx, stream, jsonrpc2.AsyncHandler(h), jsonrpc2.SetLogger(base.GetBaseLogger()))
+	c := &client{conn: rpcConn, legacy: h.legacy, privileged: h.privileged}
+	clientsMux.Lock()
+	Clients = append(Clients, c)
+	clientsMux.Unlock()
 	<-rpcConn.DisconnectNotify()
-	for i, c := range Clients {
-		if c == rpcConn {
+	clientsMux.Lock()
+	for i := range Clients {
+		if Clients[i] == c {
 			Clients = append(Clients[:i], Clients[i+1:]...)
 			base.Debug(fmt.Sprintf("client %d disconnected", i))
 			break
 		}
 	}
+	clientsMux.Unlock()
 }
 
-// Handle ID 即方法
-func (_ *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+// Handle 按照方法名路由，兼容模式下方法名未知时按照 ID 路由
+func (h *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	defer func() {
 		if err := recover(); err != nil {
 			base.Error(string(debug.Stack()))
 		}
 	}()
 
+	// 客户端发送的通知不需要回复
+	if req.Notif {
+		base.Debug("receive rpc notification:", req.Method)
+		return
+	}
+
+	method := req.Method
+	if _, ok := methods[method]; !ok && h.legacy && !req.ID.IsString {
+		if m, ok := legacyMethods[req.ID.Num]; ok {
+			method = m
+		}
+	}
+
+	privileged, ok := methods[method]
+	if !ok {
+		base.Debug("receive rpc call:", req)
+		h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrUnknownMethod, "unknown method: %s", req.Method))
+		return
+	}
+	if privileged && !h.privileged {
+		h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrPermissionDenied, "permission denied: %s", method))
+		return
+	}
+
 	// request route
-	switch req.ID.Num {
-	case STAT:
+	switch method {
+	case "stat":
 		// 未连接之前不应该调用这里
-		if session.Sess.CSess != nil {
-			_ = conn.Reply(ctx, req.ID, session.Sess.CSess.Stat)
+		if cSess := session.Sess.CSess; cSess != nil {
+			_ = conn.Reply(ctx, req.ID, cSess.GetStat())
 			return
 		}
-		jError := jsonrpc2.Error{Code: 1, Message: disconnectedStr}
-		_ = conn.ReplyWithError(ctx, req.ID, &jError)
-	case STATUS:
+		h.replyError(ctx, conn, req.ID, errNotConnected())
+	case "status":
 		// 未连接之前不应该调用这里
-		if session.Sess.CSess != nil {
-			if !base.Cfg.NoDTLS && session.Sess.CSess.DTLSPort != "" {
+		if cSess := session.Sess.CSess; cSess != nil {
+			if !base.Cfg.NoDTLS && cSess.DTLSPort != "" {
 				// 等待 DTLS 隧道创建过程结束，无论隧道是否建立成功
-				<-session.Sess.CSess.DtlsSetupChan
+				<-cSess.DtlsSetupChan
 			}
 
 			if session.Sess.CSess != nil {
@@ -102,91 +208,402 @@ func (_ *handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			}
 		}
 
-		jError := jsonrpc2.Error{Code: 1, Message: disconnectedStr}
-		_ = conn.ReplyWithError(ctx, req.ID, &jError)
-	case CONNECT:
+		h.replyError(ctx, conn, req.ID, errNotConnected())
+	case "connect":
 		// 启动时未连接，其它 UI 连接后再次调用
-		if session.Sess.CSess != nil {
-			_ = conn.Reply(ctx, req.ID, connectedStr)
+		if session.Sess.State.Current() == session.StateConnected {
+			// 旧版前端将其视为连接成功
+			if h.legacy {
+				_ = conn.Reply(ctx, req.ID, connectedStr)
+			} else {
+				h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrAlreadyConnected, "%s", connectedStr))
+			}
 			return
 		}
-		err := json.Unmarshal(*req.Params, auth.Prof)
-		if err != nil {
-			jError := jsonrpc2.Error{Code: 1, Message: err.Error()}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
+		if req.Params == nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "missing params"))
 			return
 		}
-		err = Connect()
+		err := h.checkFiles(*req.Params, nil)
+		if err == nil {
+			err = connect(*req.Params)
+		}
 		if err != nil {
 			base.Error(err)
-			jError := jsonrpc2.Error{Code: 1, Message: err.Error()}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
-			DisConnect()
+			h.replyError(ctx, conn, req.ID, err)
 			return
 		}
-		connectedStr = "connected to " + auth.Prof.Host
-		disconnectedStr = "disconnected from " + auth.Prof.Host
+		alwaysOnPaused.Store(false)
 		_ = conn.Reply(ctx, req.ID, connectedStr)
-		go monitor()
-	case RECONNECT:
+	case "reconnect":
 		// UI 未检测到活动网络发生变化或者网络变化后已经推送接口信息
-		if session.Sess.CSess != nil {
-			_ = conn.Reply(ctx, req.ID, connectedStr)
+		if session.Sess.State.Current() == session.StateConnected {
+			// 旧版前端将其视为连接成功
+			if h.legacy {
+				_ = conn.Reply(ctx, req.ID, connectedStr)
+			} else {
+				h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrAlreadyConnected, "%s", connectedStr))
+			}
 			return
 		}
-		err := SetupTunnel(true)
+		err := reconnect(triggerRPC)
 		if err != nil {
 			base.Error(err)
-			jError := jsonrpc2.Error{Code: 1, Message: err.Error()}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
-			DisConnect()
+			h.replyError(ctx, conn, req.ID, err)
 			return
 		}
 		_ = conn.Reply(ctx, req.ID, connectedStr)
-		go monitor()
-	case DISCONNECT:
-		if session.Sess.CSess != nil {
-			DisConnect()
-		} else {
-			jError := jsonrpc2.Error{Code: 1, Message: disconnectedStr}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
+	case "disconnect":
+		err := h.checkDisconnect()
+		if err == nil {
+			err = disconnect()
+		}
+		// 断网保护只由 disconnect 方法和可信网络的自动断开解除，连接失败和退出都保留；
+		// 重连失败后已经不是连接状态，此时只解除保护
+		if err == nil || base.AsError(err).Code == base.ErrNotConnected {
+			if found, kErr := vpnc.DisableKillSwitch(); found || err == nil {
+				err = kErr
+			}
+		}
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		alwaysOnPaused.Store(true)
+		// 兼容模式下由 monitor 向 DISCONNECT 发送伪响应
+		if !h.legacy {
+			_ = conn.Reply(ctx, req.ID, disconnectedStr)
+		}
+	case "abort", "cancel":
+		err := h.checkDisconnect()
+		if err == nil {
+			err = abort()
 		}
-	case CONFIG:
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		alwaysOnPaused.Store(true)
+		_ = conn.Reply(ctx, req.ID, "connection cancelled")
+	case "state":
+		_ = conn.Reply(ctx, req.ID, session.Sess.State.Get())
+	case "config":
 		// 初始化配置
-		err := json.Unmarshal(*req.Params, &base.Cfg)
+		if req.Params == nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "missing params"))
+			return
+		}
+		// 连接过程在其它 goroutine 中读取配置，只能在未连接时修改；先解析到副本，验证通过后再替换
+		err := session.Sess.State.WithState([]session.State{session.StateIdle, session.StateFailed}, func() error {
+			cfg := *base.Cfg
+			if err := json.Unmarshal(*req.Params, &cfg); err != nil {
+				return base.NewError(base.ErrInvalidParams, err)
+			}
+			if err := cfg.Overrides.Validate(); err != nil {
+				return err
+			}
+			// 其它系统没有实现，不能让前端以为已经受到保护
+			if cfg.KillSwitch && runtime.GOOS != "linux" {
+				return base.Errorf(base.ErrInvalidParams, "kill switch is not supported on %s", runtime.GOOS)
+			}
+			*base.Cfg = cfg
+			// 每次重启客户端或者配置更改，重置 logger
+			base.InitLog()
+			return nil
+		})
 		if err != nil {
-			jError := jsonrpc2.Error{Code: 1, Message: err.Error()}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
+			h.replyError(ctx, conn, req.ID, err)
 			return
 		}
 		_ = conn.Reply(ctx, req.ID, "ready to connect")
-		// 每次重启客户端或者配置更改，重置 logger
-		base.InitLog()
-	case INTERFACE:
+	case "groups":
+		// 只发送 init 请求，不影响连接状态
+		var params struct {
+			Host   string `json:"host"`
+			Secret string `json:"secret"`
+		}
+		if req.Params != nil {
+			_ = json.Unmarshal(*req.Params, &params)
+		}
+		if params.Host == "" {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "missing host"))
+			return
+		}
+		info, err := auth.DiscoverGroups(ctx, params.Host, params.Secret)
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		_ = conn.Reply(ctx, req.ID, info)
+	case "prompt":
+		_ = conn.Reply(ctx, req.ID, currentPrompt())
+	case "input":
+		var reply session.PromptReply
+		if req.Params == nil || json.Unmarshal(*req.Params, &reply) != nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "invalid params"))
+			return
+		}
+		err := input(&reply)
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		_ = conn.Reply(ctx, req.ID, "ok")
+	case "history":
+		_ = conn.Reply(ctx, req.ID, session.History.Entries())
+	case "cleanup":
+		// 回滚崩溃遗留的修改，包括断网保护，连接期间执行会破坏当前连接
+		state := session.Sess.State.Current()
+		if state != session.StateIdle && state != session.StateFailed {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrConflict, "the VPN is %s, disconnect first", state))
+			return
+		}
+		if err := h.checkDisconnect(); err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		entries, err := vpnc.Cleanup(false)
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, base.NewError(base.ErrRoutingFailed, err).WithData(entries))
+			return
+		}
+		if entries == nil {
+			entries = []vpnc.JournalEntry{}
+		}
+		_ = conn.Reply(ctx, req.ID, entries)
+	case "trusted_network":
+		_ = conn.Reply(ctx, req.ID, currentTrustedNetwork())
+	case "dynamic_routes":
+		if cSess := session.Sess.CSess; cSess != nil {
+			_ = conn.Reply(ctx, req.ID, cSess.DynamicRoutes.List())
+			return
+		}
+		h.replyError(ctx, conn, req.ID, errNotConnected())
+	case "profile.list":
+		profiles, err := base.Profiles.List()
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		if !h.privileged {
+			for _, p := range profiles {
+				p.Redact()
+			}
+		}
+		_ = conn.Reply(ctx, req.ID, profiles)
+	case "profile.get", "profile.create", "profile.update", "profile.delete":
+		p := new(base.ConnProfile)
+		if req.Params == nil || json.Unmarshal(*req.Params, p) != nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "invalid params"))
+			return
+		}
+		var err error
+		switch method {
+		case "profile.get":
+			p, err = base.Profiles.Get(p.Name)
+			if err == nil && !h.privileged {
+				p.Redact()
+			}
+		case "profile.create":
+			if err = h.checkFiles(*req.Params, nil); err == nil {
+				err = base.Profiles.Create(p)
+			}
+		case "profile.update":
+			old, _ := base.Profiles.Get(p.Name)
+			if err = h.checkProfile(p.Name); err == nil {
+				err = h.checkFiles(*req.Params, old)
+			}
+			if err == nil {
+				err = base.Profiles.Update(p)
+			}
+		case "profile.delete":
+			if err = h.checkProfile(p.Name); err == nil {
+				err = base.Profiles.Delete(p.Name)
+			}
+			if err == nil {
+				// 凭据随连接配置一起删除
+				_ = base.Vault.Clear(p.Name)
+			}
+		}
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		_ = conn.Reply(ctx, req.ID, p)
+	case "credential.list":
+		infos, err := base.Vault.List()
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		_ = conn.Reply(ctx, req.ID, infos)
+	case "credential.set", "credential.clear":
+		var params struct {
+			Profile    string `json:"profile"`
+			Passphrase string `json:"passphrase"`
+			base.Credential
+		}
+		if req.Params == nil || json.Unmarshal(*req.Params, &params) != nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "invalid params"))
+			return
+		}
+		err := h.checkProfile(params.Profile)
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		if method == "credential.set" {
+			// 凭据只能属于已有的连接配置
+			var p *base.ConnProfile
+			if p, err = base.Profiles.Get(params.Profile); err == nil {
+				err = base.Vault.Set(params.Profile, p.CredentialScope(), &params.Credential, params.Passphrase)
+			}
+		} else {
+			err = base.Vault.Clear(params.Profile)
+		}
+		if err != nil {
+			h.replyError(ctx, conn, req.ID, err)
+			return
+		}
+		_ = conn.Reply(ctx, req.ID, "ok")
+	case "interface":
+		if req.Params == nil {
+			h.replyError(ctx, conn, req.ID, base.Errorf(base.ErrInvalidParams, "missing params"))
+			return
+		}
 		err := json.Unmarshal(*req.Params, base.LocalInterface)
 		if err != nil {
-			jError := jsonrpc2.Error{Code: 1, Message: err.Error()}
-			_ = conn.ReplyWithError(ctx, req.ID, &jError)
+			h.replyError(ctx, conn, req.ID, base.NewError(base.ErrInvalidParams, err))
 			return
 		}
 		auth.Prof.Initialized = true
 		_ = conn.Reply(ctx, req.ID, "ready to connect")
-	default:
-		base.Debug("receive rpc call:", req)
-		jError := jsonrpc2.Error{Code: 1, Message: "unknown method: " + req.Method}
-		_ = conn.ReplyWithError(ctx, req.ID, &jError)
 	}
 }
 
+// checkFiles params 中的证书、私钥和 CA 文件由 root 打开，前端自己必须可以读取，与连接配置 old 中相同的文件不检查
+func (h *handler) checkFiles(params json.RawMessage, old *base.ConnProfile) error {
+	if h.checkFile == nil {
+		return nil
+	}
+	var files struct {
+		CertFile string `json:"cert_file"`
+		KeyFile  string `json:"key_file"`
+		CAFile   string `json:"ca_file"`
+	}
+	_ = json.Unmarshal(params, &files)
+	if old == nil {
+		old = &base.ConnProfile{}
+	}
+	for _, path := range []string{files.CertFile, files.KeyFile, files.CAFile} {
+		if path == "" || path == old.CertFile || path == old.KeyFile || path == old.CAFile {
+			continue
+		}
+		if err := h.checkFile(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorData 错误的结构化信息，兼容模式下 Code 为 1，通过 code 字段区分错误类型
+type errorData struct {
+	Error   string         `json:"error"`
+	Code    base.ErrorCode `json:"code"`
+	Details interface{}    `json:"details,omitempty"`
+}
+
+func (h *handler) replyError(ctx context.Context, conn *jsonrpc2.Conn, id jsonrpc2.ID, err error) {
+	e := base.AsError(err)
+	code := e.Code
+	if h.legacy {
+		code = base.ErrUnknown
+	}
+	jError := &jsonrpc2.Error{Code: int64(code), Message: e.Message}
+	jError.SetError(errorData{Error: e.Code.String(), Code: e.Code, Details: e.Data})
+	_ = conn.ReplyWithError(ctx, id, jError)
+}
+
+func errNotConnected() error {
+	if disconnectedStr == "" {
+		return base.Errorf(base.ErrNotConnected, "not connected")
+	}
+	return base.Errorf(base.ErrNotConnected, "%s", disconnectedStr)
+}
+
+// methods 方法名及是否需要修改权限
+var methods = map[string]bool{
+	"status":     false,
+	"state":      false,
+	"stat":       false,
+	"config":     true,
+	"connect":    true,
+	"disconnect": true,
+	"reconnect":  true,
+	"abort":      true,
+	"cancel":     true,
+	"interface":  true,
+	"groups":     true,
+	"prompt":     false,
+	"input":      true,
+	"history":    true,
+	"cleanup":    true,
+
+	"trusted_network": false,
+	"dynamic_routes":  false,
+
+	"profile.list":   false,
+	"profile.get":    false,
+	"profile.create": true,
+	"profile.update": true,
+	"profile.delete": true,
+
+	"credential.list":  false,
+	"credential.set":   true,
+	"credential.clear": true,
+}
+
+// notify 向所有客户端发送通知，不会等待客户端响应
+func notify(method string, params interface{}) {
+	ctx := context.Background()
+	for _, c := range clients() {
+		_ = c.conn.Notify(ctx, method, params)
+	}
+}
+
+// clients 发送可能阻塞，复制之后在锁外发送，避免一个客户端阻塞其它客户端的连接和断开
+func clients() []*client {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	return append([]*client{}, Clients...)
+}
+
 func monitor() {
 	// 不考虑 DTLS 中途关闭情形
 	<-session.Sess.CloseChan
+
+	if session.Sess.ActiveClose {
+		// 由 disconnect 方法、信号或者服务停止触发
+		_ = session.Sess.State.Transition(session.StateDisconnecting, nil)
+		_ = session.Sess.State.Transition(session.StateIdle, nil)
+		session.History.End(nil)
+		notify(EventDisconnected, disconnectedStr)
+	} else {
+		err := errors.New("connection aborted")
+		_ = session.Sess.State.Transition(session.StateFailed, err)
+		session.History.End(err)
+		notify(EventAborted, disconnectedStr)
+	}
+
 	ctx := context.Background()
-	for _, conn := range Clients {
+	for _, c := range clients() {
+		if !c.legacy {
+			continue
+		}
 		if session.Sess.ActiveClose {
-			_ = conn.Reply(ctx, jsonrpc2.ID{Num: DISCONNECT, IsString: false}, disconnectedStr)
+			_ = c.conn.Reply(ctx, jsonrpc2.ID{Num: DISCONNECT, IsString: false}, disconnectedStr)
 		} else {
-			_ = conn.Reply(ctx, jsonrpc2.ID{Num: ABORT, IsString: false}, disconnectedStr)
+			_ = c.conn.Reply(ctx, jsonrpc2.ID{Num: ABORT, IsString: false}, disconnectedStr)
 		}
 	}
 }
@@ -0,0 +1,240 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"sslcon/auth"
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils"
+	"sslcon/utils/vpnc"
+)
+
+const (
+	// tndDebounce 网络切换时会连续产生多个事件，等待稳定后再检测
+	tndDebounce = 3 * time.Second
+	// tndInterval 不支持网络变化通知的系统定时检测
+	tndInterval = 5 * time.Minute
+	tndTimeout  = 5 * time.Second
+)
+
+// TrustedNetworkStatus trusted_network 方法返回的最近一次检测结果
+type TrustedNetworkStatus struct {
+	Profile   string    `json:"profile"`
+	Trusted   bool      `json:"trusted"`
+	Reason    string    `json:"reason,omitempty"` // 不可信的原因
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+var (
+	// tndTrusted 处于可信网络并且策略为断开时暂停 always on
+	tndTrusted atomic.Bool
+	tndMux     sync.Mutex
+	tndStatus  *TrustedNetworkStatus
+)
+
+// StartTrustedNetworkDetection vpnagent 启动时调用，连接配置需要包含 trusted_network
+func StartTrustedNetworkDetection() {
+	name := base.AgentCfg.TrustedNetworkProfile
+	if name == "" {
+		name = base.AgentCfg.AlwaysOn
+	}
+	if name == "" {
+		return
+	}
+	p, err := base.Profiles.Get(name)
+	if err != nil {
+		base.Error("trusted network:", err)
+		return
+	}
+	if p.TrustedNetwork == nil {
+		if base.AgentCfg.TrustedNetworkProfile != "" {
+			base.Error("trusted network: no trusted_network in profile", name)
+		}
+		return
+	}
+	changes := make(chan struct{}, 1)
+	err = vpnc.WatchNetwork(nil, func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		base.Warn("trusted network:", err)
+	}
+	base.Info("trusted network detection:", name)
+	go trustedNetwork(name, changes)
+}
+
+func trustedNetwork(name string, changes chan struct{}) {
+	var last *bool
+	for {
+		// 每次重新读取，修改连接配置后无需重启
+		p, err := base.Profiles.Get(name)
+		if err != nil || p.TrustedNetwork == nil {
+			base.Error("trusted network: profile", name, "removed or changed, detection stopped")
+			tndTrusted.Store(false)
+			wakeAlwaysOn()
+			return
+		}
+		status := &TrustedNetworkStatus{Profile: name, CheckedAt: time.Now()}
+		status.Trusted, status.Reason = checkTrustedNetwork(p.TrustedNetwork)
+		tndMux.Lock()
+		tndStatus = status
+		tndMux.Unlock()
+		// 只在检测结果变化时执行策略，不覆盖用户在同一网络中的手动操作
+		if last == nil || *last != status.Trusted {
+			last = &status.Trusted
+			applyTrustedPolicy(p, status)
+		}
+
+		select {
+		case <-changes:
+			time.Sleep(tndDebounce)
+			select {
+			case <-changes:
+			default:
+			}
+		case <-time.After(tndInterval):
+		}
+	}
+}
+
+func applyTrustedPolicy(p *base.ConnProfile, status *TrustedNetworkStatus) {
+	tn := p.TrustedNetwork
+	state := session.Sess.State.Current()
+	if status.Trusted {
+		base.Info("trusted network detected")
+		if tn.TrustedPolicy == base.PolicyNone {
+			return
+		}
+		tndTrusted.Store(true)
+		if state == session.StateConnected || state.InProgress() {
+			if err := disconnect(); err != nil {
+				base.Error("trusted network:", err)
+				return
+			}
+		}
+		// 可信网络中不需要断网保护，否则断开后无法访问网络
+		if _, err := vpnc.DisableKillSwitch(); err != nil {
+			base.Error("trusted network:", err)
+		}
+		return
+	}
+
+	base.Info("untrusted network detected:", status.Reason)
+	tndTrusted.Store(false)
+	if base.AgentCfg.AlwaysOn != "" {
+		wakeAlwaysOn()
+		return
+	}
+	if tn.UntrustedPolicy == base.PolicyNone || (state != session.StateIdle && state != session.StateFailed) {
+		return
+	}
+	params, _ := json.Marshal(map[string]string{"profile": p.Name})
+	go func() {
+		if err := connect(params); err != nil {
+			base.Error("trusted network:", err)
+		}
+	}()
+}
+
+// currentTrustedNetwork 未启用或者尚未检测时返回 nil
+func currentTrustedNetwork() *TrustedNetworkStatus {
+	tndMux.Lock()
+	defer tndMux.Unlock()
+	return tndStatus
+}
+
+// checkTrustedNetwork 配置的条件全部满足才可信，只检查物理网卡
+func checkTrustedNetwork(tn *base.TrustedNetwork) (bool, string) {
+	// 未连接时刷新物理网卡，连接后默认路由可能指向 VPN
+	if !auth.Prof.Initialized && session.Sess.State.Current() == session.StateIdle {
+		_ = vpnc.GetLocalInterface()
+	}
+	servers, domains := vpnc.LocalDNS()
+	if len(tn.DNSDomains) > 0 && !matchDomains(tn.DNSDomains, domains) {
+		return false, fmt.Sprintf("dns domains %v not trusted", domains)
+	}
+	if len(tn.DNSServers) > 0 {
+		if len(servers) == 0 {
+			return false, "no dns server"
+		}
+		for _, s := range servers {
+			if !utils.InArray(tn.DNSServers, s) {
+				return false, fmt.Sprintf("dns server %s not trusted", s)
+			}
+		}
+	}
+	if tn.URL != "" {
+		if err := probeTrustedURL(tn.URL, tn.CertHash, servers); err != nil {
+			return false, err.Error()
+		}
+	}
+	return true, ""
+}
+
+func matchDomains(trusted, domains []string) bool {
+	for _, d := range domains {
+		for _, t := range trusted {
+			if d == t || strings.HasSuffix(d, "."+t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeTrustedURL 只完成 TLS 握手并比较服务端证书指纹，域名使用物理网卡的 DNS 解析
+func probeTrustedURL(rawURL, certHash string, servers []string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	// 断网保护放行 ProbeControl 标记的流量
+	dialer := &net.Dialer{Timeout: tndTimeout, Control: vpnc.ProbeControl}
+	if len(servers) > 0 {
+		dnsDialer := &net.Dialer{Timeout: tndTimeout, Control: vpnc.ProbeControl}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dnsDialer.DialContext(ctx, network, net.JoinHostPort(servers[0], "53"))
+			},
+		}
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(u.Hostname(), port), &tls.Config{
+		ServerName: u.Hostname(),
+		// 通过指纹验证，内网服务器通常使用私有证书
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return fmt.Errorf("trusted url unreachable: %s", err)
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("trusted url has no certificate")
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	if hex.EncodeToString(sum[:]) != certHash {
+		return fmt.Errorf("trusted url certificate mismatch")
+	}
+	base.Debug("trusted url reachable:", conn.LocalAddr(), "->", conn.RemoteAddr())
+	return nil
+}
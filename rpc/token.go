@@ -0,0 +1,140 @@
+package rpc
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"sslcon/base"
+)
+
+// 前端在 WebSocket 握手时通过请求头发送 token，浏览器无法设置请求头，同时请求 Protocol 和 TokenProtocolPrefix+token 两个子协议
+const (
+	TokenHeader         = "X-SSLCon-Token"
+	Protocol            = "sslcon"
+	TokenProtocolPrefix = "token."
+)
+
+var token string
+
+// TokenFile 每台机器只生成一次，只有 root 或管理员以及 base.AgentCfg.TokenGroup 组成员可以读取
+func TokenFile() string {
+	return filepath.Join(base.ConfigDir, "token")
+}
+
+// ReadToken 供 sslcon 命令行等前端读取
+func ReadToken() (string, error) {
+	data, err := os.ReadFile(TokenFile())
+	if err != nil {
+		return "", err
+	}
+	t := strings.TrimSpace(string(data))
+	if t == "" {
+		return "", errors.New("empty token file " + TokenFile())
+	}
+	return t, nil
+}
+
+// initToken 读取已有 token，不存在则生成，每次启动都会修正文件权限
+func initToken() error {
+	var err error
+	token, err = ReadToken()
+	if err != nil {
+		b := make([]byte, 32)
+		if _, err = rand.Read(b); err != nil {
+			return err
+		}
+		token = hex.EncodeToString(b)
+		if err = os.MkdirAll(base.ConfigDir, 0755); err != nil {
+			return err
+		}
+		return writeTokenFile(token)
+	}
+	return restrictTokenFile(TokenFile())
+}
+
+// writeTokenFile 先创建只有 root 可以读写的空文件并修正所有者和权限，再写入 token 并重命名，期间其它用户无法读取
+func writeTokenFile(token string) error {
+	tmp := TokenFile() + ".tmp"
+	_ = os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_ = f.Close()
+	if err = restrictTokenFile(tmp); err == nil {
+		err = os.WriteFile(tmp, []byte(token+"\n"), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, TokenFile())
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// checkToken 不接受查询参数，URL 会被写入日志或者经过代理
+func checkToken(req *http.Request) bool {
+	t := req.Header.Get(TokenHeader)
+	if t == "" {
+		for _, p := range websocket.Subprotocols(req) {
+			if strings.HasPrefix(p, TokenProtocolPrefix) {
+				t = strings.TrimPrefix(p, TokenProtocolPrefix)
+				break
+			}
+		}
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+}
+
+// checkOrigin 非浏览器客户端不发送 Origin，浏览器页面必须同源或者在 base.AgentCfg.AllowedOrigins 中
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range base.AgentCfg.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// listenAll 至少有一个地址监听成功即可，如系统禁用 IPv6 时 [::1] 无法监听
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var (
+		listeners []net.Listener
+		lastErr   error
+	)
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			base.Warn("rpc listen:", err)
+			lastErr = err
+			continue
+		}
+		base.Info("rpc listen on", addr)
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no rpc address configured")
+		}
+		return nil, lastErr
+	}
+	return listeners, nil
+}
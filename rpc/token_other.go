@@ -0,0 +1,31 @@
+//go:build !windows
+
+package rpc
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+
+	"sslcon/base"
+)
+
+// restrictTokenFile root 所有，只有 base.AgentCfg.TokenGroup 组成员可以读取，修改所有者之后才允许组读取
+func restrictTokenFile(name string) error {
+	if err := os.Chmod(name, 0600); err != nil {
+		return err
+	}
+	gid := 0
+	if base.AgentCfg.TokenGroup != "" {
+		g, err := user.LookupGroup(base.AgentCfg.TokenGroup)
+		if err != nil {
+			base.Warn("token group:", err)
+		} else {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	if err := os.Chown(name, 0, gid); err != nil {
+		return err
+	}
+	return os.Chmod(name, 0640)
+}
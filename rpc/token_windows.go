@@ -0,0 +1,29 @@
+package rpc
+
+import (
+	"golang.org/x/sys/windows"
+	"sslcon/base"
+)
+
+// restrictTokenFile ProgramData 下的文件默认所有用户可以读取，替换为只允许 SYSTEM、管理员和 base.AgentCfg.TokenGroup 组读取的 DACL，不继承上级目录
+func restrictTokenFile(name string) error {
+	sddl := "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+	if base.AgentCfg.TokenGroup != "" {
+		sid, _, _, err := windows.LookupSID("", base.AgentCfg.TokenGroup)
+		if err != nil {
+			base.Warn("token group:", err)
+		} else {
+			sddl += "(A;;FR;;;" + sid.String() + ")"
+		}
+	}
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(name, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION, nil, nil, dacl, nil)
+}
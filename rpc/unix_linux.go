@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sourcegraph/jsonrpc2"
+	"golang.org/x/sys/unix"
+	"sslcon/base"
+)
+
+// setupUnix 任何用户都可以连接并读取状态，通过 SO_PEERCRED 判断是否允许修改连接状态
+func setupUnix() bool {
+	path := base.AgentCfg.RPCSocket
+	if path == "" {
+		return false
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		base.Error("rpc socket:", err)
+		return false
+	}
+	// 上次异常退出遗留的 socket 文件
+	_ = os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		base.Error("rpc socket:", err)
+		return false
+	}
+	_ = os.Chmod(path, 0666)
+	base.Info("rpc listen on", path)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				base.Error("rpc socket:", err)
+				return
+			}
+			go serveUnix(conn.(*net.UnixConn))
+		}
+	}()
+	return true
+}
+
+func serveUnix(conn *net.UnixConn) {
+	defer conn.Close()
+
+	cred, err := peerCred(conn)
+	if err != nil {
+		base.Error("rpc socket peer credentials:", err)
+		return
+	}
+	base.Debug("rpc socket peer pid:", cred.Pid, "uid:", cred.Uid, "gid:", cred.Gid)
+	h := &handler{privileged: peerPrivileged(cred), admin: cred.Uid == 0, checkFile: peerFileCheck(cred)}
+	serveConn(context.Background(), jsonrpc2.NewPlainObjectStream(conn), h)
+}
+
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// peerFileCheck root 之外的前端只能使用自己可以读取的证书、私钥和 CA 文件
+func peerFileCheck(cred *unix.Ucred) func(string) error {
+	if cred.Uid == 0 {
+		return nil
+	}
+	gids := []uint32{cred.Gid}
+	if u, err := user.LookupId(strconv.Itoa(int(cred.Uid))); err == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if gid, err := strconv.Atoi(id); err == nil {
+				gids = append(gids, uint32(gid))
+			}
+		}
+	}
+	return func(path string) error {
+		if !readableBy(path, cred.Uid, gids) {
+			return base.Errorf(base.ErrPermissionDenied, "%s is not readable by uid %d", path, cred.Uid)
+		}
+		return nil
+	}
+}
+
+// peerPrivileged root 或者 base.AgentCfg.AdminGroup 组成员（包括附加组）
+func peerPrivileged(cred *unix.Ucred) bool {
+	if cred.Uid == 0 {
+		return true
+	}
+	if base.AgentCfg.AdminGroup == "" {
+		return false
+	}
+	g, err := user.LookupGroup(base.AgentCfg.AdminGroup)
+	if err != nil {
+		return false
+	}
+	if g.Gid == strconv.Itoa(int(cred.Gid)) {
+		return true
+	}
+	u, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		return false
+	}
+	gids, _ := u.GroupIds()
+	for _, gid := range gids {
+		if gid == g.Gid {
+			return true
+		}
+	}
+	return false
+}
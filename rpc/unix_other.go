@@ -0,0 +1,8 @@
+//go:build !linux
+
+package rpc
+
+// setupUnix 目前只在 Linux 上提供 Unix socket
+func setupUnix() bool {
+	return false
+}
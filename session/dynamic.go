@@ -0,0 +1,142 @@
+package session
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 动态分流路由类型
+const (
+	RouteInclude = "include" // 经过 VPN
+	RouteExclude = "exclude" // 经过物理网卡
+)
+
+const (
+	// dynamicRouteGrace TTL 过期后应用可能仍在使用已建立的连接
+	dynamicRouteGrace = 5 * time.Minute
+	// dynamicRouteMinTTL 避免 TTL 为 0 或者很小的应答频繁增删路由
+	dynamicRouteMinTTL = 60
+	// dynamicRouteLimit 超出时淘汰最早过期的记录
+	dynamicRouteLimit = 4096
+)
+
+// DynamicRoute 动态分流域名解析得到的一个地址，同一地址可能属于多个域名，所有记录过期后才删除路由
+type DynamicRoute struct {
+	Domain    string    `json:"domain"`
+	IP        string    `json:"ip"`
+	Route     string    `json:"route"`
+	TTL       uint32    `json:"ttl"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"` // 包括 grace
+}
+
+// DynamicRoutes 域名 → 地址 → 路由表，只记录，增删路由由调用方完成
+type DynamicRoutes struct {
+	mux     sync.Mutex
+	entries map[string]*DynamicRoute
+	refs    map[string]int // 路由类型和地址 → 引用的域名数
+}
+
+func NewDynamicRoutes() *DynamicRoutes {
+	return &DynamicRoutes{entries: make(map[string]*DynamicRoute), refs: make(map[string]int)}
+}
+
+func dynamicKey(route, domain, ip string) string {
+	return route + " " + domain + " " + ip
+}
+
+// Update 合并一次应答，answers 为地址及其 TTL，返回需要添加路由的新地址，以及因超出上限淘汰、需要删除路由的记录
+func (d *DynamicRoutes) Update(route, domain string, answers map[string]uint32) ([]string, []DynamicRoute) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	now := time.Now()
+	var added []string
+	for ip, ttl := range answers {
+		e, ok := d.entries[dynamicKey(route, domain, ip)]
+		if !ok {
+			e = &DynamicRoute{Domain: domain, IP: ip, Route: route}
+			d.entries[dynamicKey(route, domain, ip)] = e
+			d.refs[route+" "+ip]++
+			if d.refs[route+" "+ip] == 1 {
+				added = append(added, ip)
+			}
+		}
+		e.TTL = ttl
+		e.UpdatedAt = now
+		e.ExpiresAt = now.Add(time.Duration(max(ttl, dynamicRouteMinTTL))*time.Second + dynamicRouteGrace)
+	}
+
+	var evicted []DynamicRoute
+	if len(d.entries) > dynamicRouteLimit {
+		all := d.sorted(func(a, b *DynamicRoute) bool { return a.ExpiresAt.Before(b.ExpiresAt) })
+		for _, e := range all[:len(all)-dynamicRouteLimit] {
+			evicted = append(evicted, d.remove(e)...)
+		}
+	}
+	return added, evicted
+}
+
+// Expire 删除过期的记录，返回不再被任何域名引用、需要删除路由的记录
+func (d *DynamicRoutes) Expire(now time.Time) []DynamicRoute {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	var expired []DynamicRoute
+	for _, e := range d.entries {
+		if now.After(e.ExpiresAt) {
+			expired = append(expired, d.remove(e)...)
+		}
+	}
+	return expired
+}
+
+// IPs 已添加路由的地址，网关变化或者断开时使用
+func (d *DynamicRoutes) IPs(route string) []string {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	var ips []string
+	for key := range d.refs {
+		if r, ip, _ := strings.Cut(key, " "); r == route {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// List 按域名和地址排序，供 dynamic_routes 方法返回
+func (d *DynamicRoutes) List() []DynamicRoute {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	all := d.sorted(func(a, b *DynamicRoute) bool {
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		return a.IP < b.IP
+	})
+	list := make([]DynamicRoute, 0, len(all))
+	for _, e := range all {
+		list = append(list, *e)
+	}
+	return list
+}
+
+func (d *DynamicRoutes) sorted(less func(a, b *DynamicRoute) bool) []*DynamicRoute {
+	all := make([]*DynamicRoute, 0, len(d.entries))
+	for _, e := range d.entries {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return less(all[i], all[j]) })
+	return all
+}
+
+// remove 地址仍被其它域名引用时不返回
+func (d *DynamicRoutes) remove(e *DynamicRoute) []DynamicRoute {
+	delete(d.entries, dynamicKey(e.Route, e.Domain, e.IP))
+	ref := e.Route + " " + e.IP
+	if d.refs[ref]--; d.refs[ref] > 0 {
+		return nil
+	}
+	delete(d.refs, ref)
+	return []DynamicRoute{*e}
+}
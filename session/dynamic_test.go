@@ -0,0 +1,154 @@
+package session
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDynamicRoutesUpdate(t *testing.T) {
+	type update struct {
+		route   string
+		domain  string
+		answers map[string]uint32
+		added   []string
+	}
+	tests := []struct {
+		name    string
+		updates []update
+		include []string
+		exclude []string
+	}{
+		{
+			name: "new addresses",
+			updates: []update{
+				{RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 300, "10.1.0.2": 300}, []string{"10.1.0.1", "10.1.0.2"}},
+			},
+			include: []string{"10.1.0.1", "10.1.0.2"},
+		},
+		{
+			name: "same answer again",
+			updates: []update{
+				{RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 300}, []string{"10.1.0.1"}},
+				{RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 30}, nil},
+			},
+			include: []string{"10.1.0.1"},
+		},
+		{
+			name: "address shared by two domains",
+			updates: []update{
+				{RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 300}, []string{"10.1.0.1"}},
+				{RouteInclude, "wiki.corp.example", map[string]uint32{"10.1.0.1": 300, "10.1.0.3": 300}, []string{"10.1.0.3"}},
+			},
+			include: []string{"10.1.0.1", "10.1.0.3"},
+		},
+		{
+			name: "include and exclude are counted separately",
+			updates: []update{
+				{RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 300}, []string{"10.1.0.1"}},
+				{RouteExclude, "cdn.example", map[string]uint32{"10.1.0.1": 300}, []string{"10.1.0.1"}},
+			},
+			include: []string{"10.1.0.1"},
+			exclude: []string{"10.1.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDynamicRoutes()
+			for i, u := range tt.updates {
+				added, evicted := d.Update(u.route, u.domain, u.answers)
+				slices.Sort(added)
+				if !slices.Equal(added, u.added) {
+					t.Errorf("update %d: added = %v, want %v", i, added, u.added)
+				}
+				if len(evicted) != 0 {
+					t.Errorf("update %d: evicted = %v", i, evicted)
+				}
+			}
+			include, exclude := d.IPs(RouteInclude), d.IPs(RouteExclude)
+			slices.Sort(include)
+			slices.Sort(exclude)
+			if !slices.Equal(include, tt.include) {
+				t.Errorf("IPs(include) = %v, want %v", include, tt.include)
+			}
+			if !slices.Equal(exclude, tt.exclude) {
+				t.Errorf("IPs(exclude) = %v, want %v", exclude, tt.exclude)
+			}
+		})
+	}
+}
+
+func TestDynamicRoutesExpire(t *testing.T) {
+	d := NewDynamicRoutes()
+	d.Update(RouteInclude, "git.corp.example", map[string]uint32{"10.1.0.1": 0, "10.1.0.2": 0})
+	d.Update(RouteInclude, "wiki.corp.example", map[string]uint32{"10.1.0.1": 3600})
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		expired []string
+		left    []string
+	}{
+		// TTL 0 按最小 TTL 计算，再加上 grace
+		{"within grace", dynamicRouteMinTTL*time.Second + dynamicRouteGrace - time.Minute, nil, []string{"10.1.0.1", "10.1.0.2"}},
+		// 10.1.0.1 仍被 wiki.corp.example 引用
+		{"short TTL", dynamicRouteMinTTL*time.Second + dynamicRouteGrace + time.Minute, []string{"10.1.0.2"}, []string{"10.1.0.1"}},
+		{"long TTL", time.Hour + dynamicRouteGrace + time.Minute, []string{"10.1.0.1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expired []string
+			for _, e := range d.Expire(now.Add(tt.after)) {
+				expired = append(expired, e.IP)
+			}
+			slices.Sort(expired)
+			if !slices.Equal(expired, tt.expired) {
+				t.Errorf("Expire = %v, want %v", expired, tt.expired)
+			}
+			left := d.IPs(RouteInclude)
+			slices.Sort(left)
+			if !slices.Equal(left, tt.left) {
+				t.Errorf("IPs = %v, want %v", left, tt.left)
+			}
+		})
+	}
+	if list := d.List(); len(list) != 0 {
+		t.Errorf("List = %v, want empty", list)
+	}
+}
+
+func TestDynamicRoutesEvict(t *testing.T) {
+	d := NewDynamicRoutes()
+	// 最早过期的记录被淘汰
+	d.Update(RouteInclude, "old.corp.example", map[string]uint32{"10.0.0.1": 60})
+	for i := 0; i < dynamicRouteLimit-1; i++ {
+		d.Update(RouteInclude, fmt.Sprintf("host%d.corp.example", i), map[string]uint32{"10.2.0.1": 3600})
+	}
+	if n := len(d.List()); n != dynamicRouteLimit {
+		t.Fatalf("List has %d entries, want %d", n, dynamicRouteLimit)
+	}
+
+	added, evicted := d.Update(RouteInclude, "new.corp.example", map[string]uint32{"10.3.0.1": 3600})
+	if !slices.Equal(added, []string{"10.3.0.1"}) {
+		t.Errorf("added = %v, want [10.3.0.1]", added)
+	}
+	if len(evicted) != 1 || evicted[0].Domain != "old.corp.example" || evicted[0].IP != "10.0.0.1" {
+		t.Errorf("evicted = %v, want old.corp.example 10.0.0.1", evicted)
+	}
+	if n := len(d.List()); n != dynamicRouteLimit {
+		t.Errorf("List has %d entries, want %d", n, dynamicRouteLimit)
+	}
+
+	// 被淘汰的 host 记录的地址仍被其它域名引用，不删除路由
+	_, evicted = d.Update(RouteInclude, "b.corp.example", map[string]uint32{"10.4.0.1": 3600})
+	if len(evicted) != 0 {
+		t.Errorf("evicted = %v, want none", evicted)
+	}
+	ips := d.IPs(RouteInclude)
+	slices.Sort(ips)
+	if want := []string{"10.2.0.1", "10.3.0.1", "10.4.0.1"}; !slices.Equal(ips, want) {
+		t.Errorf("IPs = %v, want %v", ips, want)
+	}
+}
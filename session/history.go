@@ -0,0 +1,147 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"sslcon/base"
+)
+
+// maxHistory 只保留最近的连接记录
+const maxHistory = 100
+
+// History 连接历史，持久化到 base.StateDir/history.json，用于审计 banner 确认等
+var History = &history{}
+
+// HistoryEntry 每次 connect 或 reconnect 一条记录
+type HistoryEntry struct {
+	Host        string         `json:"host"`
+	Username    string         `json:"username"`
+	Group       string         `json:"group,omitempty"`
+	Reconnect   bool           `json:"reconnect,omitempty"`
+	StartedAt   time.Time      `json:"startedAt"`
+	ConnectedAt time.Time      `json:"connectedAt,omitzero"`
+	EndedAt     time.Time      `json:"endedAt,omitzero"`
+	Error       string         `json:"error,omitempty"`
+	Banners     []BannerRecord `json:"banners,omitempty"`
+}
+
+type BannerRecord struct {
+	Kind     string    `json:"kind"`
+	Banner   string    `json:"banner"`
+	Accepted bool      `json:"accepted"`
+	At       time.Time `json:"at"`
+}
+
+type history struct {
+	mux     sync.Mutex
+	entries []*HistoryEntry
+	current *HistoryEntry
+}
+
+func historyFile() string {
+	return filepath.Join(base.StateDir, "history.json")
+}
+
+// Load vpnagent 启动时读取，文件不存在或损坏时从空记录开始
+func (h *history) Load() {
+	data, err := os.ReadFile(historyFile())
+	if err != nil {
+		return
+	}
+	var entries []*HistoryEntry
+	if err = json.Unmarshal(data, &entries); err != nil {
+		base.Warn("history:", err)
+		return
+	}
+	h.mux.Lock()
+	h.entries = entries
+	h.mux.Unlock()
+}
+
+// Begin 开始一次连接，之前未结束的记录视为异常结束
+func (h *history) Begin(host, username, group string, reconnect bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.endLocked("interrupted")
+	h.current = &HistoryEntry{
+		Host:      host,
+		Username:  username,
+		Group:     group,
+		Reconnect: reconnect,
+		StartedAt: time.Now(),
+	}
+	h.entries = append(h.entries, h.current)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+	h.save()
+}
+
+func (h *history) Connected() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.current != nil {
+		h.current.ConnectedAt = time.Now()
+		h.save()
+	}
+}
+
+// End 连接失败或断开，err 为 nil 表示正常断开
+func (h *history) End(err error) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	}
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.endLocked(msg)
+	h.save()
+}
+
+// Banner 记录用户对 banner 的确认结果
+func (h *history) Banner(kind, banner string, accepted bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.current != nil {
+		h.current.Banners = append(h.current.Banners, BannerRecord{Kind: kind, Banner: banner, Accepted: accepted, At: time.Now()})
+		h.save()
+	}
+}
+
+// Entries 返回副本，最新的记录在最后
+func (h *history) Entries() []HistoryEntry {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	entries := make([]HistoryEntry, 0, len(h.entries))
+	for _, e := range h.entries {
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+func (h *history) endLocked(msg string) {
+	if h.current == nil {
+		return
+	}
+	h.current.EndedAt = time.Now()
+	h.current.Error = msg
+	h.current = nil
+}
+
+// save 历史记录仅 root 可读
+func (h *history) save() {
+	data, err := json.MarshalIndent(h.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(base.StateDir, 0755); err == nil {
+		err = os.WriteFile(historyFile(), data, 0600)
+	}
+	if err != nil {
+		base.Warn("history:", err)
+	}
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"context"
+	"errors"
+
+	"sslcon/base"
+)
+
+// 需要用户确认的 banner 类型，也是 Prompt.Kind
+const (
+	BannerPreLogin  = "pre_login_banner"
+	BannerPostLogin = "post_login_banner"
+)
+
+// Prompt 连接过程中需要前端确认或输入的内容
+type Prompt struct {
+	ID      uint64        `json:"id"`
+	Kind    string        `json:"kind"`
+	Message string        `json:"message"`
+	Fields  []PromptField `json:"fields,omitempty"` // 需要用户输入的字段，为空表示只需确认
+}
+
+type PromptField struct {
+	Name   string `json:"name"`
+	Label  string `json:"label"`
+	Secret bool   `json:"secret"` // 密码等不应回显的字段
+}
+
+// PromptReply 前端的回复，ID 必须与 Prompt.ID 一致
+type PromptReply struct {
+	ID     uint64            `json:"id"`
+	Accept bool              `json:"accept"`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// ErrNoFrontend Prompt 在没有可以回复的前端时立即返回该错误，而不是等待 InputTimeout
+var ErrNoFrontend = errors.New("no interactive frontend connected")
+
+// AcceptBanner 开启 base.AgentCfg.RequireBannerAcceptance 时等待用户确认，拒绝或无法确认则连接失败，结果记录到连接历史
+func (sess *Session) AcceptBanner(ctx context.Context, kind, banner string) error {
+	if banner == "" {
+		return nil
+	}
+	base.Info(kind+":", banner)
+	if !base.AgentCfg.RequireBannerAcceptance {
+		return nil
+	}
+	// 重连时服务端再次下发相同的 banner
+	if kind == BannerPostLogin && banner == sess.acceptedBanner {
+		return nil
+	}
+	if sess.Prompt == nil {
+		return base.Errorf(base.ErrBannerRejected, "banner acceptance required but %s", ErrNoFrontend)
+	}
+	reply, err := sess.Prompt(ctx, &Prompt{Kind: kind, Message: banner})
+	if errors.Is(err, ErrNoFrontend) {
+		History.Banner(kind, banner, false)
+		return base.Errorf(base.ErrBannerRejected, "banner acceptance required but %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	History.Banner(kind, banner, reply.Accept)
+	if !reply.Accept {
+		return base.Errorf(base.ErrBannerRejected, "banner rejected by user")
+	}
+	if kind == BannerPostLogin {
+		sess.acceptedBanner = banner
+	}
+	return nil
+}
+
+// ResetBanners 每次重新认证前调用，重连不调用
+func (sess *Session) ResetBanners() {
+	sess.PreLoginBanner = ""
+	sess.PostLoginBanner = ""
+	sess.acceptedBanner = ""
+}
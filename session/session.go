@@ -1,8 +1,11 @@
 package session
 
 import (
+	"context"
 	"encoding/xml"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,7 +18,7 @@ import (
 )
 
 var (
-	Sess = &Session{}
+	Sess = &Session{State: NewStateMachine()}
 )
 
 type Session struct {
@@ -25,34 +28,43 @@ type Session struct {
 	ActiveClose bool
 	CloseChan   chan struct{} // 用于通知所有 UI，ConnSession 已关闭
 	CSess       *ConnSession
-}
 
-type stat struct {
-	// be sure to use the double type when parsing
-	BytesSent     uint64 `json:"bytesSent"`
-	BytesReceived uint64 `json:"bytesReceived"`
+	State *StateMachine // 连接状态，修改连接状态的操作都要先通过它
+
+	// Prompt 由前端实现，连接过程中需要用户确认或输入时调用
+	Prompt          func(ctx context.Context, p *Prompt) (*PromptReply, error)
+	PreLoginBanner  string // 登录前 banner，每次认证时重置
+	PostLoginBanner string // 认证成功后 XML 中的 banner，X-CSTP-Banner 优先
+	acceptedBanner  string // 已确认的登录后 banner，重连时相同则不再确认
 }
 
 // ConnSession used for both TLS and DTLS
 type ConnSession struct {
 	Sess *Session `json:"-"`
 
-	ServerAddress string
-	LocalAddress  string
-	Hostname      string
-	TunName       string
-	VPNAddress    string // The IPv4 address of the client
-	VPNMask       string // IPv4 netmask
-	DNS           []string
-	MTU           int
-	SplitInclude  []string
-	SplitExclude  []string
-
-	DynamicSplitTunneling       bool
-	DynamicSplitIncludeDomains  []string
-	DynamicSplitIncludeResolved sync.Map // https://github.com/golang/go/issues/31136
-	DynamicSplitExcludeDomains  []string
-	DynamicSplitExcludeResolved sync.Map
+	ServerAddress    string
+	LocalAddress     string
+	Hostname         string
+	TunName          string
+	VPNAddress       string // The IPv4 address of the client
+	VPNMask          string // IPv4 netmask
+	DNS              []string
+	DefaultDomain    string   // X-CSTP-Default-Domain，可能包含多个以空格或逗号分隔的域名，写入 search
+	SplitDNS         []string // X-CSTP-Split-DNS，不为空时只有这些域名使用 VPN 的 DNS
+	DNSForwarder     string   // 内置 DNS 转发器运行时为其地址，系统 DNS 指向它
+	DNSForwarderLink string   // 转发器同时监听的 VPN 网卡地址，systemd-resolved 通过 VPN 网卡发送查询，无法到达回环地址
+	MTU              int
+	SplitInclude     []string
+	SplitExclude     []string
+	Overrides        base.Overrides // 用户自定义的路由和域名，SetRoutes 合并后以上路由和动态分流域名为实际生效的值
+
+	LocalLANAllowed bool     // 服务端明确允许访问本地局域网，未下发时同样允许
+	LocalLAN        []string // 已排除的物理网卡直连网段，属于 SplitExclude
+
+	DynamicSplitTunneling      bool
+	DynamicSplitIncludeDomains []string
+	DynamicSplitExcludeDomains []string
+	DynamicRoutes              *DynamicRoutes `json:"-"` // 动态分流域名解析得到的地址，按 TTL 过期
 
 	TLSCipherSuite    string
 	TLSDpdTime        int // https://datatracker.ietf.org/doc/html/rfc3706
@@ -62,6 +74,10 @@ type ConnSession struct {
 	DTLSKeepaliveTime int
 	DTLSId            string `json:"-"` // used by the server to associate the DTLS channel with the CSTP channel
 	DTLSCipherSuite   string
+	SessionTimeout    int       // 秒，0 表示服务端未限制
+	ConnectedAt       time.Time // 隧道建立时间
+	PreLoginBanner    string
+	Banner            string // 登录后 banner
 	Stat              *stat
 
 	closeOnce      sync.Once           `json:"-"`
@@ -84,16 +100,18 @@ type DtlsSession struct {
 }
 
 func (sess *Session) NewConnSession(header *http.Header) *ConnSession {
+	inSize, outSize := queueSize(base.Cfg.PayloadInSize), queueSize(base.Cfg.PayloadOutSize)
 	cSess := &ConnSession{
 		Sess:              sess,
 		LocalAddress:      base.LocalInterface.Ip4,
-		Stat:              &stat{0, 0},
+		Stat:              newStat(inSize, outSize),
+		DynamicRoutes:     NewDynamicRoutes(),
 		closeOnce:         sync.Once{},
 		CloseChan:         make(chan struct{}),
 		DtlsSetupChan:     make(chan struct{}),
-		PayloadIn:         make(chan *proto.Payload, 64),
-		PayloadOutTLS:     make(chan *proto.Payload, 64),
-		PayloadOutDTLS:    make(chan *proto.Payload, 64),
+		PayloadIn:         make(chan *proto.Payload, inSize),
+		PayloadOutTLS:     make(chan *proto.Payload, outSize),
+		PayloadOutDTLS:    make(chan *proto.Payload, outSize),
 		DtlsConnected:     atomic.NewBool(false),
 		ResetTLSReadDead:  atomic.NewBool(true),
 		ResetDTLSReadDead: atomic.NewBool(true),
@@ -111,14 +129,36 @@ func (sess *Session) NewConnSession(header *http.Header) *ConnSession {
 	cSess.VPNMask = header.Get("X-CSTP-Netmask")
 	cSess.MTU, _ = strconv.Atoi(header.Get("X-CSTP-MTU"))
 	cSess.DNS = header.Values("X-CSTP-DNS")
+	cSess.DefaultDomain = header.Get("X-CSTP-Default-Domain")
+	cSess.SplitDNS = SplitDomains(header.Values("X-CSTP-Split-DNS")...)
 	// 如果服务器下发空字符串，字符串数组不会为 nil，会导致解析ip时报错
 	cSess.SplitInclude = header.Values("X-CSTP-Split-Include")
 	cSess.SplitExclude = header.Values("X-CSTP-Split-Exclude")
+	// 与 AnyConnect 相同，服务端排除 0.0.0.0/32 表示允许访问本地局域网，它不是路由
+	cSess.SplitExclude = slices.DeleteFunc(cSess.SplitExclude, func(r string) bool {
+		if r == "0.0.0.0/255.255.255.255" || r == "0.0.0.0/32" {
+			cSess.LocalLANAllowed = true
+			return true
+		}
+		return false
+	})
 	// debug with https://ip.900cha.com/
 	// cSess.SplitExclude = append(cSess.SplitExclude, "47.243.165.103/255.255.255.255")
 
 	cSess.TLSDpdTime, _ = strconv.Atoi(header.Get("X-CSTP-DPD"))
 	cSess.TLSKeepaliveTime, _ = strconv.Atoi(header.Get("X-CSTP-Keepalive"))
+	// ocserv 不限制时下发 none，Atoi 失败即为 0
+	cSess.SessionTimeout, _ = strconv.Atoi(header.Get("X-CSTP-Session-Timeout"))
+	cSess.ConnectedAt = time.Now()
+	cSess.PreLoginBanner = sess.PreLoginBanner
+	cSess.Banner = sess.PostLoginBanner
+	if banner := header.Get("X-CSTP-Banner"); banner != "" {
+		// 部分服务端 URL 编码换行等字符，解码失败则原样显示
+		if unescaped, err := url.PathUnescape(banner); err == nil {
+			banner = unescaped
+		}
+		cSess.Banner = banner
+	}
 	// https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-02#section-2.1.5.1
 	cSess.DTLSId = header.Get("X-DTLS-Session-ID")
 	if cSess.DTLSId == "" {
@@ -183,12 +223,16 @@ func (cSess *ConnSession) DPDTimer() {
 				// base.Debug("dead peer detection")
 				select {
 				case cSess.PayloadOutTLS <- &tlsDpd:
+					cSess.Stat.TLS.DpdSent()
 				default:
+					cSess.Stat.TLS.Queue.Drop()
 				}
 				if cSess.DtlsConnected.Load() {
 					select {
 					case cSess.PayloadOutDTLS <- &dtlsDpd:
+						cSess.Stat.DTLS.DpdSent()
 					default:
+						cSess.Stat.DTLS.Queue.Drop()
 					}
 				}
 			case <-cSess.CloseChan:
@@ -199,6 +243,18 @@ func (cSess *ConnSession) DPDTimer() {
 	}()
 }
 
+// SessionRemaining 距离服务端强制断开的剩余时间，服务端未限制时返回 -1
+func (cSess *ConnSession) SessionRemaining() time.Duration {
+	if cSess.SessionTimeout <= 0 {
+		return -1
+	}
+	remaining := time.Duration(cSess.SessionTimeout)*time.Second - time.Since(cSess.ConnectedAt)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
 func (cSess *ConnSession) ReadDeadTimer() {
 	go func() {
 		defer func() {
@@ -220,6 +276,19 @@ func (cSess *ConnSession) ReadDeadTimer() {
 	}()
 }
 
+// SplitDomains 拆分以逗号或空格分隔的域名，统一为小写并去掉首尾的点
+func SplitDomains(values ...string) []string {
+	var domains []string
+	for _, v := range values {
+		for _, d := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if d = strings.ToLower(strings.Trim(d, ".")); d != "" {
+				domains = append(domains, d)
+			}
+		}
+	}
+	return domains
+}
+
 func (cSess *ConnSession) Close() {
 	cSess.closeOnce.Do(func() {
 		if cSess.DtlsConnected.Load() {
@@ -0,0 +1,119 @@
+package session
+
+import (
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// stat 所有计数器均为原子操作，tls、dtls、tun 协程并发更新，rpc 协程并发读取
+type stat struct {
+	// be sure to use the double type when parsing
+	BytesSent     atomic.Uint64 `json:"bytesSent"`
+	BytesReceived atomic.Uint64 `json:"bytesReceived"`
+
+	TLS       *ChannelStat `json:"tls"`
+	DTLS      *ChannelStat `json:"dtls"`
+	PayloadIn *QueueStat   `json:"payloadIn"` // TLS 和 DTLS 共用
+}
+
+// ChannelStat 单个通道的统计，Queue 对应 PayloadOutTLS 或 PayloadOutDTLS
+type ChannelStat struct {
+	PacketsSent        atomic.Uint64   `json:"packetsSent"`
+	PacketsReceived    atomic.Uint64   `json:"packetsReceived"`
+	BytesSent          atomic.Uint64   `json:"bytesSent"`
+	BytesReceived      atomic.Uint64   `json:"bytesReceived"`
+	CompressedReceived atomic.Uint64   `json:"compressedReceived"` // 0x08 COMPRESSED DATA，暂不支持解压，计入 Discarded
+	RawReceived        atomic.Uint64   `json:"rawReceived"`        // 0x00 DATA
+	Discarded          atomic.Uint64   `json:"discarded"`          // 收到后无法处理而丢弃的数据包
+	DpdRTT             atomic.Duration `json:"dpdRtt"`             // 最近一次 DPD 往返时间，纳秒
+	Queue              *QueueStat      `json:"queue"`
+
+	dpdSentAt atomic.Int64 // 最近一次发送 DPD-REQ 的时间，UnixNano
+	total     *stat
+}
+
+// QueueStat 通道队列深度、峰值及丢弃的数据包
+type QueueStat struct {
+	Capacity  int           `json:"capacity"`
+	Depth     atomic.Int64  `json:"depth"`
+	HighWater atomic.Int64  `json:"highWater"`
+	Drops     atomic.Uint64 `json:"drops"`
+}
+
+// queueSize 前端未配置或配置错误时使用默认队列长度
+func queueSize(size int) int {
+	if size <= 0 {
+		return 64
+	}
+	return size
+}
+
+func newStat(inSize, outSize int) *stat {
+	s := &stat{PayloadIn: &QueueStat{Capacity: inSize}}
+	s.TLS = &ChannelStat{Queue: &QueueStat{Capacity: outSize}, total: s}
+	s.DTLS = &ChannelStat{Queue: &QueueStat{Capacity: outSize}, total: s}
+	return s
+}
+
+// Sent 成功写入服务端的数据包，包括 DPD、KEEPALIVE 等控制包
+func (c *ChannelStat) Sent(n int) {
+	c.PacketsSent.Inc()
+	c.BytesSent.Add(uint64(n))
+	c.total.BytesSent.Add(uint64(n))
+}
+
+// Received 从服务端读取的数据包，typ 为 CSTP 数据包类型
+func (c *ChannelStat) Received(n int, typ byte) {
+	c.PacketsReceived.Inc()
+	c.BytesReceived.Add(uint64(n))
+	c.total.BytesReceived.Add(uint64(n))
+	switch typ {
+	case 0x00:
+		c.RawReceived.Inc()
+	case 0x08:
+		c.CompressedReceived.Inc()
+	}
+}
+
+// Discard 数据包无法处理，如不支持的压缩数据
+func (c *ChannelStat) Discard() {
+	c.Discarded.Inc()
+}
+
+// DpdSent 发送 DPD-REQ 时记录时间，收到 DPD-RESP 时计算往返时间
+func (c *ChannelStat) DpdSent() {
+	c.dpdSentAt.Store(time.Now().UnixNano())
+}
+
+// DpdReceived 收到 DPD-RESP，由服务端主动发起的 DPD 不会调用 DpdSent，忽略
+func (c *ChannelStat) DpdReceived() {
+	sentAt := c.dpdSentAt.Swap(0)
+	if sentAt != 0 {
+		c.DpdRTT.Store(time.Duration(time.Now().UnixNano() - sentAt))
+	}
+}
+
+// Observe 记录入队后的队列深度峰值
+func (q *QueueStat) Observe(depth int) {
+	d := int64(depth)
+	for {
+		hw := q.HighWater.Load()
+		if d <= hw || q.HighWater.CompareAndSwap(hw, d) {
+			return
+		}
+	}
+}
+
+// Drop 队列已满或通道已关闭导致数据包被丢弃
+func (q *QueueStat) Drop() {
+	q.Drops.Inc()
+}
+
+// GetStat 刷新各队列的当前深度后返回统计信息
+func (cSess *ConnSession) GetStat() *stat {
+	cSess.Stat.PayloadIn.Depth.Store(int64(len(cSess.PayloadIn)))
+	cSess.Stat.TLS.Queue.Depth.Store(int64(len(cSess.PayloadOutTLS)))
+	cSess.Stat.DTLS.Queue.Depth.Store(int64(len(cSess.PayloadOutDTLS)))
+	return cSess.Stat
+}
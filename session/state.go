@@ -0,0 +1,156 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"sslcon/base"
+)
+
+type State int
+
+const (
+	StateIdle State = iota
+	StateResolving
+	StateAuthenticating
+	StateAwaitingInput // 等待用户确认 banner、修改密码等
+	StateEstablishing
+	StateConnected
+	StateReconnecting
+	StateDisconnecting
+	StateFailed
+)
+
+var stateNames = map[State]string{
+	StateIdle:           "idle",
+	StateResolving:      "resolving",
+	StateAuthenticating: "authenticating",
+	StateAwaitingInput:  "awaiting_input",
+	StateEstablishing:   "establishing",
+	StateConnected:      "connected",
+	StateReconnecting:   "reconnecting",
+	StateDisconnecting:  "disconnecting",
+	StateFailed:         "failed",
+}
+
+// transitions 合法的状态转换，其余转换均视为冲突操作
+var transitions = map[State][]State{
+	StateIdle:           {StateResolving, StateReconnecting},
+	StateResolving:      {StateAuthenticating, StateDisconnecting, StateFailed},
+	StateAuthenticating: {StateAwaitingInput, StateEstablishing, StateDisconnecting, StateFailed},
+	StateAwaitingInput:  {StateAuthenticating, StateEstablishing, StateReconnecting, StateDisconnecting, StateFailed},
+	StateEstablishing:   {StateAwaitingInput, StateConnected, StateDisconnecting, StateFailed},
+	StateConnected:      {StateReconnecting, StateDisconnecting, StateFailed},
+	StateReconnecting:   {StateAwaitingInput, StateConnected, StateDisconnecting, StateFailed},
+	StateDisconnecting:  {StateIdle},
+	StateFailed:         {StateIdle, StateResolving, StateReconnecting, StateDisconnecting},
+}
+
+func (s State) String() string {
+	return stateNames[s]
+}
+
+func (s State) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + s.String() + `"`), nil
+}
+
+// InProgress 正在连接或重连，尚未成功或失败
+func (s State) InProgress() bool {
+	switch s {
+	case StateResolving, StateAuthenticating, StateAwaitingInput, StateEstablishing, StateReconnecting:
+		return true
+	}
+	return false
+}
+
+// StateInfo 通过 state 方法和 event.state_changed 通知返回给前端
+type StateInfo struct {
+	State       State     `json:"state"`
+	Previous    State     `json:"previous"`
+	Since       time.Time `json:"since"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitzero"`
+}
+
+// StateMachine 所有修改连接状态的操作都必须先完成状态转换，从而拒绝冲突的操作
+type StateMachine struct {
+	mux  sync.Mutex
+	info StateInfo
+
+	// OnChange 状态变化后调用，不持有锁
+	OnChange func(info StateInfo)
+}
+
+func NewStateMachine() *StateMachine {
+	return &StateMachine{info: StateInfo{State: StateIdle, Previous: StateIdle, Since: time.Now()}}
+}
+
+// Transition 状态转换不合法时返回错误，err 不为 nil 时记录为最近一次错误
+func (m *StateMachine) Transition(to State, err error) error {
+	return m.transition(nil, to, err)
+}
+
+// TransitionFrom 仅当前状态为 from 之一时转换，用于连接过程中途被断开等情形
+func (m *StateMachine) TransitionFrom(from []State, to State, err error) error {
+	return m.transition(from, to, err)
+}
+
+func (m *StateMachine) transition(from []State, to State, err error) error {
+	m.mux.Lock()
+	current := m.info.State
+	if !canTransition(current, to) || (from != nil && !inStates(from, current)) {
+		m.mux.Unlock()
+		return conflictError(current, to)
+	}
+	m.info.Previous = current
+	m.info.State = to
+	m.info.Since = time.Now()
+	if err != nil {
+		m.info.LastError = err.Error()
+		m.info.LastErrorAt = m.info.Since
+	}
+	info := m.info
+	m.mux.Unlock()
+
+	if m.OnChange != nil {
+		m.OnChange(info)
+	}
+	return nil
+}
+
+// WithState 仅当前状态为 states 之一时执行 fn，执行期间持有锁，状态不会改变，fn 不能再转换状态
+func (m *StateMachine) WithState(states []State, fn func() error) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !inStates(states, m.info.State) {
+		return base.Errorf(base.ErrConflict, "the VPN is %s, disconnect first", m.info.State)
+	}
+	return fn()
+}
+
+func (m *StateMachine) Get() StateInfo {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.info
+}
+
+func (m *StateMachine) Current() State {
+	return m.Get().State
+}
+
+func canTransition(from, to State) bool {
+	return inStates(transitions[from], to)
+}
+
+func inStates(states []State, s State) bool {
+	for _, v := range states {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func conflictError(from, to State) error {
+	return base.Errorf(base.ErrConflict, "operation not allowed while %s (requested %s)", from, to)
+}
@@ -45,6 +45,7 @@ func (p program) Start(s service.Service) error {
 func (p program) Stop(s service.Service) error {
 	logger.Info("I'm Stopping!")
 	base.Info("Stop")
+	rpc.StopAlwaysOn()
 	rpc.DisConnect()
 	return nil
 }
@@ -52,6 +53,8 @@ func (p program) Stop(s service.Service) error {
 func (p program) run() {
 	base.Setup()
 	rpc.Setup()
+	rpc.StartAlwaysOn()
+	rpc.StartTrustedNetworkDetection()
 }
 
 func RunSvc() {
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"net"
@@ -9,6 +10,7 @@ import (
 	"regexp"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/pion/dtls/v3/pkg/protocol"
 	"sslcon/base"
@@ -117,3 +119,25 @@ func RemoveBetween(input, start, end string) string {
 	r := regexp.MustCompile(pattern)
 	return r.ReplaceAllString(input, "")
 }
+
+// WatchConn 为 conn 上阻塞的读写设置超时，ctx 取消时立即中断，返回的函数用于清除超时，timeout 为 0 表示不限制
+func WatchConn(ctx context.Context, conn net.Conn, timeout time.Duration) func() {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		_ = conn.SetDeadline(time.Time{})
+	}
+}
+
+// CtxErr ctx 取消导致的读写错误统一返回 ctx.Err()
+func CtxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
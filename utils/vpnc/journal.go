@@ -0,0 +1,156 @@
+package vpnc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"sslcon/base"
+)
+
+// 日志条目类型
+const (
+	JournalRoute        = "route"         // 添加的路由，回滚时删除
+	JournalDefaultRoute = "default_route" // 调整了优先级的默认路由，回滚时恢复
+	JournalDNS          = "dns"           // 改写的 DNS 配置文件，回滚时从备份恢复
+	JournalRule         = "rule"          // 策略路由规则，回滚时删除
+	JournalKillSwitch   = "kill_switch"   // 断网保护的 nftables 表，agent 启动时保留
+	JournalSysctl       = "sysctl"        // 修改的内核参数，回滚时恢复原值
+	JournalPolicyMark   = "policy_mark"   // 为应答恢复 fwmark 的 nftables 表，回滚时删除
+)
+
+// JournalEntry 修改系统配置之前先写入日志，进程崩溃后启动时或者 sslcon cleanup 回滚
+type JournalEntry struct {
+	Type     string `json:"type"`
+	Link     string `json:"link,omitempty"` // 网卡名称，重启后 index 可能变化
+	Dst      string `json:"dst,omitempty"`
+	Gw       string `json:"gw,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Table    int    `json:"table,omitempty"`   // 为空即主路由表
+	Mark     int    `json:"mark,omitempty"`    // 规则不匹配该 fwmark 时查询 Table
+	Backend  string `json:"backend,omitempty"` // DNS 后端，为空等同于 file
+	File     string `json:"file,omitempty"`
+	Backup   string `json:"backup,omitempty"`
+	Host     string `json:"host,omitempty"`  // 断网保护对应的服务器域名，重连时不再解析
+	Value    string `json:"value,omitempty"` // 内核参数修改前的值
+}
+
+var journalMux sync.Mutex
+
+func journalFile() string {
+	return filepath.Join(base.StateDir, "state.json")
+}
+
+// dnsBackupFile 保存在 StateDir 而不是 /tmp，重启后仍可恢复
+func dnsBackupFile() string {
+	return filepath.Join(base.StateDir, "resolv.conf.bak")
+}
+
+func (e *JournalEntry) same(o *JournalEntry) bool {
+	return e.Type == o.Type && e.Link == o.Link && e.Dst == o.Dst && e.File == o.File && e.Table == o.Table
+}
+
+// journalAdd 已存在的条目不重复记录
+func journalAdd(entries ...JournalEntry) {
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	all := loadJournal()
+	for i := range entries {
+		found := false
+		for j := range all {
+			if all[j].same(&entries[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			all = append(all, entries[i])
+		}
+	}
+	saveJournal(all)
+}
+
+// journalRemove 撤销修改之后调用
+func journalRemove(entries ...JournalEntry) {
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	all := loadJournal()
+	kept := all[:0]
+	for i := range all {
+		removed := false
+		for j := range entries {
+			if all[i].same(&entries[j]) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, all[i])
+		}
+	}
+	saveJournal(kept)
+}
+
+// Journal 返回尚未撤销的修改
+func Journal() []JournalEntry {
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	return loadJournal()
+}
+
+// Cleanup 逆序回滚日志中遗留的修改，只能在没有连接时调用，返回回滚的条目；
+// keepKillSwitch 时保留断网保护，agent 重启期间也不能放行
+func Cleanup(keepKillSwitch bool) ([]JournalEntry, error) {
+	journalMux.Lock()
+	defer journalMux.Unlock()
+	all := loadJournal()
+	var undone, kept []JournalEntry
+	var err error
+	for i := len(all) - 1; i >= 0; i-- {
+		if keepKillSwitch && all[i].Type == JournalKillSwitch {
+			kept = append(kept, all[i])
+			continue
+		}
+		if e := undo(&all[i]); e != nil {
+			base.Warn("cleanup:", all[i].Type, all[i].Dst, all[i].File, e)
+			err = e
+		}
+		undone = append(undone, all[i])
+	}
+	slices.Reverse(undone)
+	slices.Reverse(kept)
+	saveJournal(kept)
+	return undone, err
+}
+
+func loadJournal() []JournalEntry {
+	var all []JournalEntry
+	data, err := os.ReadFile(journalFile())
+	if err == nil {
+		err = json.Unmarshal(data, &all)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		base.Error("journal:", err)
+	}
+	return all
+}
+
+func saveJournal(all []JournalEntry) {
+	if len(all) == 0 {
+		_ = os.Remove(journalFile())
+		return
+	}
+	data, _ := json.MarshalIndent(all, "", "  ")
+	err := os.MkdirAll(base.StateDir, 0755)
+	if err == nil {
+		tmp := journalFile() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, journalFile())
+		}
+	}
+	if err != nil {
+		base.Error("journal:", err)
+	}
+}
@@ -0,0 +1,214 @@
+package vpnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils"
+)
+
+// killSwitchTable inet 表同时过滤 IPv4 和 IPv6，隧道只支持 IPv4，IPv6 只允许回环和 VPN 网卡
+const killSwitchTable = "sslcon"
+
+// EnableKillSwitch 添加或者替换断网保护，发出和转发的流量只允许回环、VPN 网卡、服务器地址和 DHCP，可选允许本地网络，
+// 发出的流量还允许可信网络探测；
+// 重连时不删除，只由 disconnect、可信网络的自动断开或者 sslcon cleanup 解除
+func EnableKillSwitch(cSess *session.ConnSession) error {
+	host, _, err := net.SplitHostPort(cSess.Hostname)
+	if err != nil {
+		host = cSess.Hostname
+	}
+	entry := JournalEntry{Type: JournalKillSwitch, Link: cSess.TunName, Dst: cSess.ServerAddress, Host: host}
+	// 每个连接只保留一条记录，服务器地址可能已经变化
+	journalRemove(killSwitchEntries()...)
+	journalAdd(entry)
+
+	var lan []*net.IPNet
+	if base.Cfg.KillSwitchLAN {
+		for _, r := range connectedNetworks(base.LocalInterface.Ip4) {
+			if _, ipNet, err := net.ParseCIDR(utils.IpMaskToCIDR(r)); err == nil {
+				lan = append(lan, ipNet)
+			}
+		}
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	// 同一批次中清空并重建，替换期间不会放行
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: killSwitchTable})
+	conn.FlushTable(table)
+	policy := nftables.ChainPolicyDrop
+	output := conn.AddChain(&nftables.Chain{
+		Name:     "output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	// 作为网关时局域网的流量也只能经过 VPN
+	forward := conn.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	var rules [][]expr.Any
+	rules = append(rules, matchOifname("lo"), matchOifname(cSess.TunName))
+	if ip := net.ParseIP(cSess.ServerAddress).To4(); ip != nil {
+		rules = append(rules, matchDaddr(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}))
+	}
+	rules = append(rules, matchDHCP())
+	for _, ipNet := range lan {
+		rules = append(rules, matchDaddr(ipNet))
+	}
+	for _, chain := range []*nftables.Chain{output, forward} {
+		chainRules := rules
+		if chain == forward {
+			// VPN 返回给局域网的应答
+			chainRules = append(chainRules[:len(chainRules):len(chainRules)], matchIifname(cSess.TunName))
+		} else {
+			// ProbeControl 标记的可信网络探测，连接期间也要检测物理网卡所在的网络
+			chainRules = append(chainRules[:len(chainRules):len(chainRules)], matchMark(policyMark))
+		}
+		for _, exprs := range chainRules {
+			conn.AddRule(&nftables.Rule{
+				Table: table,
+				Chain: chain,
+				Exprs: append(exprs[:len(exprs):len(exprs)], &expr.Verdict{Kind: expr.VerdictAccept}),
+			})
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return fmt.Errorf("kill switch: %w", err)
+	}
+	base.Info("kill switch enabled, server:", cSess.ServerAddress, "local LAN:", lan)
+	return nil
+}
+
+// DisableKillSwitch 返回是否存在需要解除的断网保护
+func DisableKillSwitch() (bool, error) {
+	entries := killSwitchEntries()
+	if len(entries) == 0 {
+		return false, nil
+	}
+	err := delKillSwitch()
+	if err != nil {
+		return true, err
+	}
+	journalRemove(entries...)
+	base.Info("kill switch disabled")
+	return true, nil
+}
+
+// KillSwitchServer 断网保护期间 DNS 不可用，返回 host 在保护生效时的服务器地址；
+// active 表示断网保护是否生效，此时无法连接其它服务器
+func KillSwitchServer(host string) (ip string, active bool) {
+	entries := killSwitchEntries()
+	if len(entries) == 0 || !killSwitchExists() {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.Host == host {
+			return e.Dst, true
+		}
+	}
+	return "", true
+}
+
+func killSwitchEntries() []JournalEntry {
+	var entries []JournalEntry
+	for _, e := range Journal() {
+		if e.Type == JournalKillSwitch {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// killSwitchExists 重启后表已不存在，但日志可能仍有记录
+func killSwitchExists() bool {
+	conn, err := nftables.New()
+	if err != nil {
+		return false
+	}
+	_, err = conn.ListTableOfFamily(killSwitchTable, nftables.TableFamilyINet)
+	return err == nil
+}
+
+// delKillSwitch 先添加再删除，表不存在时不会报错
+func delKillSwitch() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: killSwitchTable})
+	conn.DelTable(table)
+	return conn.Flush()
+}
+
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+func matchOifname(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+func matchIifname(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+func matchMark(mark uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+	}
+}
+
+func matchIPv4() []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+	}
+}
+
+// matchDaddr ip daddr ipNet，掩码为 32 时等同于比较地址
+func matchDaddr(ipNet *net.IPNet) []expr.Any {
+	return append(matchIPv4(),
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ipNet.Mask, Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipNet.IP.To4()},
+	)
+}
+
+// matchDHCP udp dport 67，租约到期前需要续约
+func matchDHCP() []expr.Any {
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, 67)
+	return append(matchIPv4(),
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: port},
+	)
+}
@@ -0,0 +1,102 @@
+package vpnc
+
+import (
+	"fmt"
+	"net"
+
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils"
+)
+
+// privateNetworks RFC1918
+var privateNetworks = []string{"10.0.0.0/255.0.0.0", "172.16.0.0/255.240.0.0", "192.168.0.0/255.255.0.0"}
+
+// applyLocalLAN 全局模式下为物理网卡直连的网段添加排除路由，断开时与其它排除路由一起删除；
+// 默认允许，服务端包含了该网段或者 VPN 网段、DNS 在该网段内时跳过
+func applyLocalLAN(cSess *session.ConnSession) {
+	o := &cSess.Overrides
+	if !o.LocalLAN && !o.LocalLANPrivate {
+		return
+	}
+	var routes []string
+	for _, r := range connectedNetworks(base.LocalInterface.Ip4) {
+		if reason := lanForbidden(cSess, r); reason != "" {
+			base.Warn("local LAN:", utils.IpMaskToCIDR(r), reason+", skipped")
+			continue
+		}
+		routes = append(routes, r)
+	}
+	cSess.LocalLAN = append([]string{}, routes...)
+	if o.LocalLANPrivate {
+		for _, r := range privateNetworks {
+			if reason := lanForbidden(cSess, r); reason != "" {
+				base.Warn("local LAN:", utils.IpMaskToCIDR(r), reason+", skipped")
+				continue
+			}
+			if !utils.InArray(routes, r) {
+				routes = append(routes, r)
+			}
+		}
+	}
+	for _, r := range routes {
+		if !routesContain(cSess.SplitExclude, r) {
+			cSess.SplitExclude = append(cSess.SplitExclude, r)
+		}
+	}
+	base.Info("local LAN:", routes)
+}
+
+// connectedNetworks 物理网卡的 IPv4 网段，ip 为 base.LocalInterface.Ip4
+func connectedNetworks(ip string) []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		base.Error("local LAN:", err)
+		return nil
+	}
+	for _, ifc := range ifaces {
+		addrs, _ := ifc.Addrs()
+		found := false
+		var networks []string
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if ipNet.IP.String() == ip {
+				found = true
+			}
+			if ones, bits := ipNet.Mask.Size(); ones < bits {
+				network := ipNet.IP.Mask(ipNet.Mask)
+				networks = append(networks, fmt.Sprintf("%s/%s", network, net.IP(ipNet.Mask)))
+			}
+		}
+		if found {
+			return networks
+		}
+	}
+	return nil
+}
+
+// lanForbidden VPN 网段和 DNS 必须经过隧道，服务端包含的网段也不能排除，全局路由除外
+func lanForbidden(cSess *session.ConnSession, ipMask string) string {
+	_, ipNet, err := net.ParseCIDR(utils.IpMaskToCIDR(ipMask))
+	if err != nil {
+		return "is invalid"
+	}
+	for _, ip := range append([]string{cSess.VPNAddress}, cSess.DNS...) {
+		if ipNet.Contains(net.ParseIP(ip)) {
+			return "contains " + ip
+		}
+	}
+	for _, r := range cSess.SplitInclude {
+		if isDefaultRoute(r) {
+			continue
+		}
+		if _, include, err := net.ParseCIDR(utils.IpMaskToCIDR(r)); err == nil &&
+			(include.Contains(ipNet.IP) || ipNet.Contains(include.IP)) {
+			return "is included by the server"
+		}
+	}
+	return ""
+}
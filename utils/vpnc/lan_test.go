@@ -0,0 +1,72 @@
+package vpnc
+
+import (
+	"slices"
+	"testing"
+
+	"sslcon/base"
+	"sslcon/session"
+)
+
+func TestApplyLocalLAN(t *testing.T) {
+	// 回环网卡在所有系统上都存在，直连网段为 127.0.0.0/8
+	old := *base.LocalInterface
+	base.LocalInterface.Ip4 = "127.0.0.1"
+	t.Cleanup(func() { *base.LocalInterface = old })
+
+	tests := []struct {
+		name    string
+		cSess   *session.ConnSession
+		lan     []string
+		exclude []string
+	}{
+		{
+			name:  "disabled",
+			cSess: &session.ConnSession{},
+		},
+		{
+			// 服务端没有下发 0.0.0.0/32 时同样允许
+			name:    "no server push",
+			cSess:   &session.ConnSession{Overrides: base.Overrides{LocalLAN: true}},
+			lan:     []string{"127.0.0.0/255.0.0.0"},
+			exclude: []string{"127.0.0.0/255.0.0.0"},
+		},
+		{
+			name:    "allowed by server",
+			cSess:   &session.ConnSession{LocalLANAllowed: true, Overrides: base.Overrides{LocalLAN: true}},
+			lan:     []string{"127.0.0.0/255.0.0.0"},
+			exclude: []string{"127.0.0.0/255.0.0.0"},
+		},
+		{
+			name: "included by server",
+			cSess: &session.ConnSession{
+				SplitInclude: []string{"0.0.0.0/0.0.0.0", "127.1.0.0/255.255.0.0"},
+				Overrides:    base.Overrides{LocalLAN: true},
+			},
+			lan: []string{},
+		},
+		{
+			name: "private networks",
+			cSess: &session.ConnSession{
+				VPNAddress:   "10.9.0.7",
+				DNS:          []string{"172.16.0.53"},
+				SplitInclude: []string{"0.0.0.0/0.0.0.0", "192.168.10.0/255.255.255.0"},
+				SplitExclude: []string{"203.0.113.0/255.255.255.0"},
+				Overrides:    base.Overrides{LocalLANPrivate: true},
+			},
+			lan:     []string{"127.0.0.0/255.0.0.0"},
+			exclude: []string{"203.0.113.0/255.255.255.0", "127.0.0.0/255.0.0.0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applyLocalLAN(tt.cSess)
+			if !slices.Equal(tt.cSess.LocalLAN, tt.lan) {
+				t.Errorf("LocalLAN = %v, want %v", tt.cSess.LocalLAN, tt.lan)
+			}
+			if !slices.Equal(tt.cSess.SplitExclude, tt.exclude) {
+				t.Errorf("SplitExclude = %v, want %v", tt.cSess.SplitExclude, tt.exclude)
+			}
+		})
+	}
+}
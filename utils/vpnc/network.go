@@ -0,0 +1,32 @@
+package vpnc
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+)
+
+// parseResolvConf 返回 nameserver 以及 search、domain 中的域名
+func parseResolvConf(name string) (servers, domains []string) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			servers = append(servers, fields[1])
+		case "search", "domain":
+			for _, d := range fields[1:] {
+				domains = append(domains, strings.ToLower(strings.TrimSuffix(d, ".")))
+			}
+		}
+	}
+	return servers, domains
+}
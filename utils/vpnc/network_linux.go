@@ -0,0 +1,135 @@
+package vpnc
+
+import (
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sslcon/base"
+)
+
+var (
+	localDNSMux sync.Mutex
+	// localDNS 设置 VPN DNS 之前的快照，连接期间 resolv.conf 已包含 VPN 的 DNS
+	localDNS *struct{ servers, domains []string }
+)
+
+// LocalDNS 物理网卡的 DNS 配置，优先按网卡读取 systemd-resolved 的配置，其次使用连接前的快照
+func LocalDNS() (servers, domains []string) {
+	if usesResolved() {
+		if link, err := net.InterfaceByName(base.LocalInterface.Name); err == nil {
+			if conn, ok := resolvedBus(); ok {
+				servers, domains, err = resolvedLinkDNS(conn, link.Index)
+				if err == nil {
+					return servers, domains
+				}
+				base.Debug("read DNS of", link.Name, "failed:", err)
+			}
+		}
+	}
+	localDNSMux.Lock()
+	defer localDNSMux.Unlock()
+	if localDNS != nil {
+		return localDNS.servers, localDNS.domains
+	}
+	return readLocalDNS()
+}
+
+// readLocalDNS systemd-resolved 的 stub 文件只有 127.0.0.53
+func readLocalDNS() (servers, domains []string) {
+	if usesResolved() {
+		return parseResolvConf("/run/systemd/resolve/resolv.conf")
+	}
+	return parseResolvConf("/etc/resolv.conf")
+}
+
+// saveLocalDNS 设置 VPN DNS 之前调用，恢复后清除
+func saveLocalDNS(save bool) {
+	localDNSMux.Lock()
+	defer localDNSMux.Unlock()
+	localDNS = nil
+	if save {
+		servers, domains := readLocalDNS()
+		localDNS = &struct{ servers, domains []string }{servers, domains}
+	}
+}
+
+// WatchNetwork 网卡、地址或者路由变化时调用 onChange，忽略 VPN 网卡自身的变化，调用方负责去抖
+func WatchNetwork(done <-chan struct{}, onChange func()) error {
+	links := make(chan netlink.LinkUpdate, 16)
+	addrs := make(chan netlink.AddrUpdate, 16)
+	routes := make(chan netlink.RouteUpdate, 16)
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return err
+	}
+	if err := netlink.AddrSubscribe(addrs, done); err != nil {
+		return err
+	}
+	if err := netlink.RouteSubscribe(routes, done); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			var index int
+			select {
+			case u, ok := <-links:
+				if !ok {
+					return
+				}
+				index = int(u.Index)
+			case u, ok := <-addrs:
+				if !ok {
+					return
+				}
+				index = u.LinkIndex
+			case u, ok := <-routes:
+				if !ok {
+					return
+				}
+				index = u.LinkIndex
+			}
+			if iface != nil && index == iface.Attrs().Index {
+				continue
+			}
+			onChange()
+		}
+	}()
+	return nil
+}
+
+// BindControl 使探测流量从物理网卡发出，不经过 VPN
+func BindControl(network, address string, c syscall.RawConn) error {
+	name := base.LocalInterface.Name
+	if name == "" {
+		return nil
+	}
+	// 本机 DNS 转发器，如 dnsmasq
+	if host, _, err := net.SplitHostPort(address); err == nil && net.ParseIP(host).IsLoopback() {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.BindToDevice(int(fd), name)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// ProbeControl 可信网络探测，在 BindControl 的基础上设置 fwmark，断网保护放行带有该标记的流量
+func ProbeControl(network, address string, c syscall.RawConn) error {
+	if err := BindControl(network, address, c); err != nil {
+		return err
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, policyMark)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
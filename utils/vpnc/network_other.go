@@ -0,0 +1,54 @@
+//go:build !linux
+
+package vpnc
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+)
+
+// LocalDNS 目前只支持读取 macOS 的 /etc/resolv.conf
+func LocalDNS() (servers, domains []string) {
+	if runtime.GOOS == "darwin" {
+		return parseResolvConf("/etc/resolv.conf")
+	}
+	return nil, nil
+}
+
+// ResolvedRunning systemd-resolved 仅存在于 Linux
+func ResolvedRunning() bool {
+	return false
+}
+
+// WatchNetwork 目前只在 Linux 上通过 netlink 实现，调用方应定时检查
+func WatchNetwork(done <-chan struct{}, onChange func()) error {
+	return errors.New("network change notification is not supported on " + runtime.GOOS)
+}
+
+func BindControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func ProbeControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// MarkControl 策略路由模式仅支持 Linux
+func MarkControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// DisableKillSwitch 断网保护仅支持 Linux
+func DisableKillSwitch() (bool, error) {
+	return false, nil
+}
+
+func KillSwitchServer(host string) (ip string, active bool) {
+	return "", false
+}
+
+// undo 目前只有 Linux 记录日志
+func undo(e *JournalEntry) error {
+	return nil
+}
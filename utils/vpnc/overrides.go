@@ -0,0 +1,192 @@
+package vpnc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils"
+)
+
+// applyOverrides 将用户自定义的路由和域名合并到服务端下发的配置，SetRoutes 最先调用，冲突时用户配置优先并记录日志
+func applyOverrides(cSess *session.ConnSession) {
+	o := &cSess.Overrides
+	include := overrideRoutes(o.IncludeRoutes)
+	exclude := overrideRoutes(o.ExcludeRoutes)
+	// 用户同时包含和排除时排除优先
+	include = filterRoutes(include, func(r string) bool {
+		if utils.InArray(exclude, r) {
+			base.Warn("override conflict: route", utils.IpMaskToCIDR(r), "is both included and excluded, excluded")
+			return false
+		}
+		return true
+	})
+
+	full := len(cSess.SplitInclude) == 0
+	for _, r := range cSess.SplitInclude {
+		full = full || isDefaultRoute(r)
+	}
+	if o.NoDefaultRoute && full {
+		base.Info("override: server default route ignored")
+		cSess.SplitInclude = filterRoutes(cSess.SplitInclude, func(r string) bool { return !isDefaultRoute(r) })
+		// VPN 的 DNS 仍然经过隧道
+		for _, dns := range cSess.DNS {
+			if ip := net.ParseIP(dns).To4(); ip != nil {
+				include = append(include, ip.String()+"/255.255.255.255")
+			}
+		}
+		full = false
+	}
+
+	// 服务端排除的路由被用户包含时不再排除，反之亦然，全局路由除外
+	cSess.SplitExclude = filterRoutes(cSess.SplitExclude, func(r string) bool {
+		if utils.InArray(include, normalizeRoute(r)) {
+			base.Warn("override conflict: route", utils.IpMaskToCIDR(r), "excluded by server, included")
+			return false
+		}
+		return true
+	})
+	cSess.SplitInclude = filterRoutes(cSess.SplitInclude, func(r string) bool {
+		if !isDefaultRoute(r) && utils.InArray(exclude, normalizeRoute(r)) {
+			base.Warn("override conflict: route", utils.IpMaskToCIDR(r), "included by server, excluded")
+			return false
+		}
+		return true
+	})
+
+	if full {
+		if len(include) > 0 {
+			base.Info("override: include routes are already covered by the server default route")
+		}
+		applyLocalLAN(cSess)
+	} else {
+		for _, r := range include {
+			if !routesContain(cSess.SplitInclude, r) {
+				cSess.SplitInclude = append(cSess.SplitInclude, r)
+			}
+		}
+		// 包含路由为空时为全局路由，至少保留 VPN 网段
+		if len(cSess.SplitInclude) == 0 {
+			cSess.SplitInclude = append(cSess.SplitInclude, vpnNetwork(cSess))
+		}
+	}
+	for _, r := range exclude {
+		if !routesContain(cSess.SplitExclude, r) {
+			cSess.SplitExclude = append(cSess.SplitExclude, r)
+		}
+	}
+
+	includeDomains := session.SplitDomains(o.IncludeDomains...)
+	excludeDomains := session.SplitDomains(o.ExcludeDomains...)
+	cSess.DynamicSplitExcludeDomains = filterDomains(cSess.DynamicSplitExcludeDomains, includeDomains, "excluded by server, included")
+	cSess.DynamicSplitIncludeDomains = filterDomains(cSess.DynamicSplitIncludeDomains, excludeDomains, "included by server, excluded")
+	includeDomains = filterDomains(includeDomains, excludeDomains, "is both included and excluded, excluded")
+	cSess.DynamicSplitIncludeDomains = appendDomains(cSess.DynamicSplitIncludeDomains, includeDomains)
+	cSess.DynamicSplitExcludeDomains = appendDomains(cSess.DynamicSplitExcludeDomains, excludeDomains)
+	if len(cSess.DynamicSplitIncludeDomains) > 0 || len(cSess.DynamicSplitExcludeDomains) > 0 {
+		cSess.DynamicSplitTunneling = true
+	}
+
+	base.Debug("effective routes, include:", cSess.SplitInclude, "exclude:", cSess.SplitExclude,
+		"include domains:", cSess.DynamicSplitIncludeDomains, "exclude domains:", cSess.DynamicSplitExcludeDomains)
+}
+
+// ApplyDNSOverrides 用户指定的 DNS 替换服务端下发的，搜索域追加到 Default-Domain；
+// 创建 tun 之前调用，内置转发器和各系统的 setDNS 都使用替换后的值
+func ApplyDNSOverrides(cSess *session.ConnSession) {
+	o := &cSess.Overrides
+	if len(o.DNSServers) > 0 {
+		var servers []string
+		for _, s := range o.DNSServers {
+			if ip := net.ParseIP(s); ip != nil && !utils.InArray(servers, ip.String()) {
+				servers = append(servers, ip.String())
+			}
+		}
+		base.Info("override: DNS servers", servers, "replace", cSess.DNS)
+		cSess.DNS = servers
+	}
+	if search := session.SplitDomains(o.SearchDomains...); len(search) > 0 {
+		cSess.DefaultDomain = strings.Join(appendDomains(session.SplitDomains(cSess.DefaultDomain), search), " ")
+	}
+}
+
+// overrideRoutes 转换为服务端下发的 ip/mask 格式，隧道只支持 IPv4
+func overrideRoutes(routes []string) []string {
+	var ipMasks []string
+	for _, r := range routes {
+		if !strings.Contains(r, "/") {
+			r += "/32"
+		}
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil || ipNet.IP.To4() == nil {
+			base.Warn("override: unsupported route", r)
+			continue
+		}
+		ipMask := fmt.Sprintf("%s/%s", ipNet.IP, net.IP(ipNet.Mask))
+		if !utils.InArray(ipMasks, ipMask) {
+			ipMasks = append(ipMasks, ipMask)
+		}
+	}
+	return ipMasks
+}
+
+// normalizeRoute 服务端下发的地址可能不是网络地址
+func normalizeRoute(ipMask string) string {
+	_, ipNet, err := net.ParseCIDR(utils.IpMaskToCIDR(ipMask))
+	if err != nil {
+		return ipMask
+	}
+	return fmt.Sprintf("%s/%s", ipNet.IP, net.IP(ipNet.Mask))
+}
+
+func isDefaultRoute(ipMask string) bool {
+	return normalizeRoute(ipMask) == "0.0.0.0/0.0.0.0"
+}
+
+func routesContain(routes []string, ipMask string) bool {
+	for _, r := range routes {
+		if normalizeRoute(r) == ipMask {
+			return true
+		}
+	}
+	return false
+}
+
+func filterRoutes(routes []string, keep func(string) bool) []string {
+	var kept []string
+	for _, r := range routes {
+		if keep(r) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func vpnNetwork(cSess *session.ConnSession) string {
+	return normalizeRoute(cSess.VPNAddress + "/" + cSess.VPNMask)
+}
+
+// filterDomains 删除 domains 中出现在 removed 里的域名，服务端下发的域名可能包含空白和首尾的点
+func filterDomains(domains, removed []string, reason string) []string {
+	var kept []string
+	for _, d := range domains {
+		name := strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if utils.InArray(removed, name) {
+			base.Warn("override conflict: domain", name, reason)
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+func appendDomains(domains, added []string) []string {
+	for _, d := range added {
+		if !utils.InArray(domains, d) {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
@@ -0,0 +1,166 @@
+package vpnc
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"sslcon/base"
+	"sslcon/session"
+)
+
+func TestMain(m *testing.M) {
+	base.Cfg.LogLevel = "Error"
+	base.InitLog()
+	os.Exit(m.Run())
+}
+
+func TestApplyOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		cSess     *session.ConnSession
+		include   []string
+		exclude   []string
+		incDomain []string
+		excDomain []string
+	}{
+		{
+			name: "split tunnel",
+			cSess: &session.ConnSession{
+				SplitInclude: []string{"10.0.0.0/255.0.0.0"},
+				Overrides:    base.Overrides{IncludeRoutes: []string{"192.168.50.0/24", "fd00::/8"}, ExcludeRoutes: []string{"10.1.0.0/16"}},
+			},
+			include: []string{"10.0.0.0/255.0.0.0", "192.168.50.0/255.255.255.0"},
+			exclude: []string{"10.1.0.0/255.255.0.0"},
+		},
+		{
+			name: "user include and exclude, exclude wins",
+			cSess: &session.ConnSession{
+				SplitInclude: []string{"10.0.0.0/255.0.0.0"},
+				Overrides:    base.Overrides{IncludeRoutes: []string{"172.16.0.0/12"}, ExcludeRoutes: []string{"172.16.0.0/12"}},
+			},
+			include: []string{"10.0.0.0/255.0.0.0"},
+			exclude: []string{"172.16.0.0/255.240.0.0"},
+		},
+		{
+			name: "server exclude included by user",
+			cSess: &session.ConnSession{
+				SplitInclude: []string{"10.0.0.0/255.0.0.0"},
+				SplitExclude: []string{"10.9.1.0/255.255.0.0"},
+				Overrides:    base.Overrides{IncludeRoutes: []string{"10.9.0.0/16"}},
+			},
+			include: []string{"10.0.0.0/255.0.0.0", "10.9.0.0/255.255.0.0"},
+		},
+		{
+			name: "server include excluded by user",
+			cSess: &session.ConnSession{
+				SplitInclude: []string{"10.0.0.0/255.0.0.0", "10.2.0.0/255.255.0.0"},
+				Overrides:    base.Overrides{ExcludeRoutes: []string{"10.2.0.0/16"}},
+			},
+			include: []string{"10.0.0.0/255.0.0.0"},
+			exclude: []string{"10.2.0.0/255.255.0.0"},
+		},
+		{
+			name: "full tunnel ignores include routes",
+			cSess: &session.ConnSession{
+				Overrides: base.Overrides{IncludeRoutes: []string{"10.1.0.0/16"}, ExcludeRoutes: []string{"203.0.113.7"}},
+			},
+			exclude: []string{"203.0.113.7/255.255.255.255"},
+		},
+		{
+			name: "no default route keeps the VPN DNS",
+			cSess: &session.ConnSession{
+				DNS:          []string{"10.9.0.53"},
+				SplitInclude: []string{"0.0.0.0/0.0.0.0"},
+				Overrides:    base.Overrides{IncludeRoutes: []string{"10.1.0.0/16"}, NoDefaultRoute: true},
+			},
+			include: []string{"10.1.0.0/255.255.0.0", "10.9.0.53/255.255.255.255"},
+		},
+		{
+			name: "no default route without includes keeps the VPN network",
+			cSess: &session.ConnSession{
+				VPNAddress:   "192.168.200.7",
+				VPNMask:      "255.255.255.0",
+				SplitInclude: []string{"0.0.0.0/0.0.0.0"},
+				Overrides:    base.Overrides{NoDefaultRoute: true},
+			},
+			include: []string{"192.168.200.0/255.255.255.0"},
+		},
+		{
+			name: "domains",
+			cSess: &session.ConnSession{
+				SplitInclude:               []string{"10.0.0.0/255.0.0.0"},
+				DynamicSplitIncludeDomains: []string{"corp.example", " .CDN.example "},
+				Overrides:                  base.Overrides{IncludeDomains: []string{"git.example", "corp.example"}, ExcludeDomains: []string{"cdn.example"}},
+			},
+			include:   []string{"10.0.0.0/255.0.0.0"},
+			incDomain: []string{"corp.example", "git.example"},
+			excDomain: []string{"cdn.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cSess := tt.cSess
+			applyOverrides(cSess)
+			if !slices.Equal(cSess.SplitInclude, tt.include) {
+				t.Errorf("SplitInclude = %v, want %v", cSess.SplitInclude, tt.include)
+			}
+			if !slices.Equal(cSess.SplitExclude, tt.exclude) {
+				t.Errorf("SplitExclude = %v, want %v", cSess.SplitExclude, tt.exclude)
+			}
+			if !slices.Equal(cSess.DynamicSplitIncludeDomains, tt.incDomain) {
+				t.Errorf("DynamicSplitIncludeDomains = %v, want %v", cSess.DynamicSplitIncludeDomains, tt.incDomain)
+			}
+			if !slices.Equal(cSess.DynamicSplitExcludeDomains, tt.excDomain) {
+				t.Errorf("DynamicSplitExcludeDomains = %v, want %v", cSess.DynamicSplitExcludeDomains, tt.excDomain)
+			}
+			if dynamic := len(tt.incDomain) > 0 || len(tt.excDomain) > 0; cSess.DynamicSplitTunneling != dynamic {
+				t.Errorf("DynamicSplitTunneling = %v, want %v", cSess.DynamicSplitTunneling, dynamic)
+			}
+		})
+	}
+}
+
+func TestApplyDNSOverrides(t *testing.T) {
+	tests := []struct {
+		name          string
+		cSess         *session.ConnSession
+		dns           []string
+		defaultDomain string
+	}{
+		{
+			name:          "no overrides",
+			cSess:         &session.ConnSession{DNS: []string{"10.9.0.53"}, DefaultDomain: "corp.example"},
+			dns:           []string{"10.9.0.53"},
+			defaultDomain: "corp.example",
+		},
+		{
+			name: "servers replaced",
+			cSess: &session.ConnSession{
+				DNS:       []string{"10.9.0.53"},
+				Overrides: base.Overrides{DNSServers: []string{"10.1.0.53", "10.1.0.53", "fd00::53"}},
+			},
+			dns: []string{"10.1.0.53", "fd00::53"},
+		},
+		{
+			name: "search domains appended",
+			cSess: &session.ConnSession{
+				DefaultDomain: "corp.example, lab.example",
+				Overrides:     base.Overrides{SearchDomains: []string{"Lab.Example.", "git.example"}},
+			},
+			defaultDomain: "corp.example lab.example git.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cSess := tt.cSess
+			ApplyDNSOverrides(cSess)
+			if !slices.Equal(cSess.DNS, tt.dns) {
+				t.Errorf("DNS = %v, want %v", cSess.DNS, tt.dns)
+			}
+			if cSess.DefaultDomain != tt.defaultDomain {
+				t.Errorf("DefaultDomain = %q, want %q", cSess.DefaultDomain, tt.defaultDomain)
+			}
+		})
+	}
+}
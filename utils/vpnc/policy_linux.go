@@ -0,0 +1,220 @@
+package vpnc
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"sslcon/base"
+)
+
+// 策略路由模式与 wg-quick 相同：主路由表中除默认路由外的路由优先，其余未标记的流量查询 VPN 路由表
+const (
+	policyTable    = 3105 // VPN 路由表
+	policyMark     = 3105 // 本程序到服务端的 TLS、DTLS 连接和可信网络探测，不查询 VPN 路由表
+	policyPriority = 3105 // suppress_prefixlength 规则的优先级，fwmark 规则紧随其后
+)
+
+// policyRouting 当前连接是否使用策略路由模式，SetRoutes 时确定，断开时使用同一模式恢复
+var policyRouting bool
+
+// routeTable VPN 路由和排除路由所在的路由表，0 即主路由表
+func routeTable() int {
+	if policyRouting {
+		return policyTable
+	}
+	return 0
+}
+
+func policyRules() []JournalEntry {
+	return []JournalEntry{
+		{Type: JournalRule, Priority: policyPriority, Table: unix.RT_TABLE_MAIN},
+		{Type: JournalRule, Priority: policyPriority + 1, Table: policyTable, Mark: policyMark},
+	}
+}
+
+// journalRule Table 为主路由表时忽略默认路由，否则不匹配 Mark 时查询 Table
+func journalRule(e *JournalEntry) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Family = unix.AF_INET
+	rule.Priority = e.Priority
+	rule.Table = e.Table
+	if e.Table == unix.RT_TABLE_MAIN {
+		rule.SuppressPrefixlen = 0
+	} else {
+		rule.Mark = uint32(e.Mark)
+		rule.Invert = true
+	}
+	return rule
+}
+
+func addRules(link string) error {
+	// 与 wg-quick 相同，应答恢复连接的 fwmark，反向路径检查才会查询主路由表
+	err := setSysctl(srcValidMark, "1")
+	if err == nil {
+		err = addMarkRestore()
+	}
+	if err != nil {
+		base.Warn("policy routing: restore fwmark on replies failed:", err)
+		checkRPFilter(link)
+	}
+	entries := policyRules()
+	journalAdd(entries...)
+	for i := range entries {
+		err := netlink.RuleAdd(journalRule(&entries[i]))
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+	}
+	return nil
+}
+
+func delRules() {
+	entries := policyRules()
+	for i := range entries {
+		_ = delRule(&entries[i])
+	}
+	journalRemove(entries...)
+	if err := delMarkRestore(); err != nil {
+		base.Warn("policy routing:", err)
+	}
+	journalRemove(JournalEntry{Type: JournalPolicyMark})
+	restoreSysctl(srcValidMark)
+}
+
+func delRule(e *JournalEntry) error {
+	err := netlink.RuleDel(journalRule(e))
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// srcValidMark 为 1 时反向路径检查使用数据包的 fwmark
+const srcValidMark = "/proc/sys/net/ipv4/conf/all/src_valid_mark"
+
+// setSysctl 已经是 value 时不修改，否则先写入原值
+func setSysctl(name, value string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	old := strings.TrimSpace(string(data))
+	if old == value {
+		return nil
+	}
+	journalAdd(JournalEntry{Type: JournalSysctl, File: name, Value: old})
+	return os.WriteFile(name, []byte(value), 0644)
+}
+
+// restoreSysctl 恢复日志中记录的原值
+func restoreSysctl(name string) {
+	for _, e := range Journal() {
+		if e.Type == JournalSysctl && e.File == name {
+			if err := undo(&e); err != nil {
+				base.Warn("restore", name, "failed:", err)
+				continue
+			}
+			journalRemove(e)
+		}
+	}
+}
+
+// policyMarkTable 连接发出时将 fwmark 保存到 conntrack，应答到达时恢复
+const policyMarkTable = "sslcon_policy"
+
+func addMarkRestore() error {
+	journalAdd(JournalEntry{Type: JournalPolicyMark})
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: policyMarkTable})
+	conn.FlushTable(table)
+	pre := conn.AddChain(&nftables.Chain{
+		Name:     "premangle",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	post := conn.AddChain(&nftables.Chain{
+		Name:     "postmangle",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	mark := binaryutil.NativeEndian.PutUint32(policyMark)
+	// ct mark 0xc21 meta mark set ct mark
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: pre,
+		Exprs: []expr.Any{
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: mark},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		},
+	})
+	// meta mark 0xc21 ct mark set meta mark
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: post,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: mark},
+			&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+		},
+	})
+	return conn.Flush()
+}
+
+// delMarkRestore 先添加再删除，表不存在时不会报错
+func delMarkRestore() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: policyMarkTable})
+	conn.DelTable(table)
+	return conn.Flush()
+}
+
+// checkRPFilter 无法恢复 fwmark 时检查，服务端的应答没有 fwmark，严格模式的反向路径检查会查询到 VPN 路由表而丢弃，实际生效的是 all 和网卡中较大的值
+func checkRPFilter(link string) {
+	mode := 0
+	for _, name := range []string{"all", link} {
+		data, err := os.ReadFile("/proc/sys/net/ipv4/conf/" + name + "/rp_filter")
+		if err != nil {
+			continue
+		}
+		if v, _ := strconv.Atoi(strings.TrimSpace(string(data))); v > mode {
+			mode = v
+		}
+	}
+	if mode == 1 {
+		base.Warn("policy routing: strict rp_filter on", link, "drops the replies from the server, set it to 2")
+	}
+}
+
+// MarkControl 策略路由模式下为到服务端的连接设置 fwmark，无需添加服务器地址的主机路由
+func MarkControl(network, address string, c syscall.RawConn) error {
+	if !base.Cfg.PolicyRouting {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, policyMark)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,333 @@
+package vpnc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"sslcon/base"
+	"sslcon/utils"
+)
+
+// DNS 后端名称
+const (
+	ResolverSystemd    = "systemd-resolved"
+	ResolverResolvconf = "resolvconf"
+	ResolverFile       = "file"
+)
+
+// dnsConfig 设置到 VPN 网卡的 DNS，Routing 为空时所有域名都使用 VPN 的 DNS
+type dnsConfig struct {
+	Link    string
+	Index   int
+	Servers []string
+	Search  []string // 搜索域，同时用于路由
+	Routing []string // 仅用于路由的域名，systemd-resolved 以外的后端不支持
+}
+
+// resolver 不同的 DNS 管理方式，Set 之前需要写入日志的由各后端自行处理
+type resolver interface {
+	Name() string
+	Set(cfg *dnsConfig) error
+	Restore(cfg *dnsConfig) error
+}
+
+// dnsResolver 当前连接使用的后端，断开时使用同一个后端恢复
+var dnsResolver resolver
+
+// detectResolver 优先使用 systemd-resolved，其次 resolvconf(8)，最后直接改写 /etc/resolv.conf
+func detectResolver() resolver {
+	if usesResolved() {
+		if conn, ok := resolvedBus(); ok {
+			return &resolvedResolver{conn: conn}
+		}
+	}
+	if path, err := exec.LookPath("resolvconf"); err == nil {
+		return &resolvconfResolver{path: path}
+	}
+	return &fileResolver{}
+}
+
+// ResolvedRunning 将使用 systemd-resolved 后端时返回 true
+func ResolvedRunning() bool {
+	if !usesResolved() {
+		return false
+	}
+	_, ok := resolvedBus()
+	return ok
+}
+
+// usesResolved /etc/resolv.conf 指向 systemd-resolved 的 stub 时，设置网卡 DNS 才会生效
+func usesResolved() bool {
+	if target, err := filepath.EvalSymlinks("/etc/resolv.conf"); err == nil && strings.HasPrefix(target, "/run/systemd/resolve/") {
+		return true
+	}
+	servers, _ := parseResolvConf("/etc/resolv.conf")
+	return utils.InArray(servers, "127.0.0.53")
+}
+
+const (
+	resolvedName = "org.freedesktop.resolve1"
+	resolvedPath = "/org/freedesktop/resolve1"
+)
+
+// systemBus 测试时替换为私有总线
+var systemBus = dbus.SystemBus
+
+// resolvedBus systemd-resolved 正在运行时返回系统总线连接
+func resolvedBus() (*dbus.Conn, bool) {
+	conn, err := systemBus()
+	if err != nil {
+		return nil, false
+	}
+	var owned bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, resolvedName).Store(&owned)
+	return conn, err == nil && owned
+}
+
+// resolvedLinkDNS 只读取全局和 index 网卡的 DNS，/run/systemd/resolve/resolv.conf 还包含 VPN 网卡的 DNS 和域名
+func resolvedLinkDNS(conn *dbus.Conn, index int) (servers, domains []string, err error) {
+	obj := conn.Object(resolvedName, resolvedPath)
+	v, err := obj.GetProperty(resolvedName + ".Manager.DNS")
+	if err != nil {
+		return nil, nil, err
+	}
+	var addrs []struct {
+		Index   int32
+		Family  int32
+		Address []byte
+	}
+	if err = v.Store(&addrs); err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		if (a.Index == 0 || int(a.Index) == index) && (len(a.Address) == net.IPv4len || len(a.Address) == net.IPv6len) {
+			servers = append(servers, net.IP(a.Address).String())
+		}
+	}
+	v, err = obj.GetProperty(resolvedName + ".Manager.Domains")
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []struct {
+		Index       int32
+		Domain      string
+		RoutingOnly bool
+	}
+	if err = v.Store(&names); err != nil {
+		return nil, nil, err
+	}
+	for _, d := range names {
+		if (d.Index == 0 || int(d.Index) == index) && !d.RoutingOnly {
+			domains = append(domains, strings.ToLower(strings.TrimSuffix(d.Domain, ".")))
+		}
+	}
+	return servers, domains, nil
+}
+
+// resolvedResolver 通过 D-Bus 设置 VPN 网卡的 DNS 和域名，网卡删除后 systemd-resolved 自动清除，无需写入日志
+type resolvedResolver struct {
+	conn *dbus.Conn
+}
+
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+func (r *resolvedResolver) Name() string {
+	return ResolverSystemd
+}
+
+func (r *resolvedResolver) Set(cfg *dnsConfig) error {
+	var addrs []resolvedAddress
+	for _, s := range cfg.Servers {
+		ip := net.ParseIP(s)
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, resolvedAddress{Family: 2, Address: ip4})
+		} else if ip != nil {
+			addrs = append(addrs, resolvedAddress{Family: 10, Address: ip.To16()})
+		}
+	}
+	var domains []resolvedDomain
+	for _, d := range cfg.Search {
+		domains = append(domains, resolvedDomain{Domain: d})
+	}
+	for _, d := range cfg.Routing {
+		// 搜索域同时用于路由
+		if !utils.InArray(cfg.Search, d) {
+			domains = append(domains, resolvedDomain{Domain: d, RoutingOnly: true})
+		}
+	}
+	// 没有分离 DNS 时所有查询都使用 VPN 的 DNS
+	defaultRoute := len(cfg.Routing) == 0
+	if defaultRoute {
+		domains = append(domains, resolvedDomain{Domain: ".", RoutingOnly: true})
+	}
+
+	obj := r.conn.Object(resolvedName, resolvedPath)
+	index := int32(cfg.Index)
+	if err := obj.Call(resolvedName+".Manager.SetLinkDNS", 0, index, addrs).Err; err != nil {
+		return fmt.Errorf("SetLinkDNS: %w", err)
+	}
+	if err := obj.Call(resolvedName+".Manager.SetLinkDomains", 0, index, domains).Err; err != nil {
+		return fmt.Errorf("SetLinkDomains: %w", err)
+	}
+	// 旧版本不支持 SetLinkDefaultRoute，只依赖 ~. 域名
+	if err := obj.Call(resolvedName+".Manager.SetLinkDefaultRoute", 0, index, defaultRoute).Err; err != nil {
+		base.Debug("SetLinkDefaultRoute:", err)
+	}
+	return nil
+}
+
+func (r *resolvedResolver) Restore(cfg *dnsConfig) error {
+	// 网卡已经删除时返回错误，忽略
+	_ = r.conn.Object(resolvedName, resolvedPath).Call(resolvedName+".Manager.RevertLink", 0, int32(cfg.Index)).Err
+	return nil
+}
+
+// resolvconfResolver 通过 resolvconf -a 为 VPN 网卡添加记录，进程崩溃后记录不会自动删除，需要写入日志
+type resolvconfResolver struct {
+	path string
+}
+
+func (r *resolvconfResolver) Name() string {
+	return ResolverResolvconf
+}
+
+func (r *resolvconfResolver) entry(cfg *dnsConfig) JournalEntry {
+	return JournalEntry{Type: JournalDNS, Backend: ResolverResolvconf, Link: "tun." + cfg.Link}
+}
+
+func (r *resolvconfResolver) Set(cfg *dnsConfig) error {
+	if len(cfg.Routing) > 0 {
+		base.Warn("resolvconf does not support split DNS, all queries use the VPN DNS")
+	}
+	var b strings.Builder
+	for _, s := range cfg.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(cfg.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(cfg.Search, " "))
+	}
+	e := r.entry(cfg)
+	journalAdd(e)
+	cmd := exec.Command(r.path, "-a", e.Link)
+	cmd.Stdin = strings.NewReader(b.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s %s", err, cmd.String(), out)
+	}
+	return nil
+}
+
+func (r *resolvconfResolver) Restore(cfg *dnsConfig) error {
+	e := r.entry(cfg)
+	err := undo(&e)
+	if err == nil {
+		journalRemove(e)
+	}
+	return err
+}
+
+// fileResolver 直接改写 /etc/resolv.conf，先备份并写入日志
+type fileResolver struct {
+	mux sync.Mutex
+	// pending 延迟写入，Restore 时取消，避免恢复之后再次写入 VPN 的 DNS
+	pending *time.Timer
+}
+
+func (r *fileResolver) Name() string {
+	return ResolverFile
+}
+
+func (r *fileResolver) entry() JournalEntry {
+	return JournalEntry{Type: JournalDNS, Backend: ResolverFile, File: "/etc/resolv.conf", Backup: dnsBackupFile()}
+}
+
+func (r *fileResolver) Set(cfg *dnsConfig) error {
+	if len(cfg.Routing) > 0 {
+		base.Warn("resolv.conf does not support split DNS, all queries use the VPN DNS")
+	}
+	e := r.entry()
+	if err := os.MkdirAll(base.StateDir, 0755); err != nil {
+		return err
+	}
+	if err := utils.CopyFile(e.Backup, e.File); err != nil {
+		return fmt.Errorf("backup DNS failed: %w", err)
+	}
+	journalAdd(e)
+
+	var b strings.Builder
+	for _, s := range cfg.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if len(cfg.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(cfg.Search, " "))
+	}
+	// 部分云服务器会在设置路由时重写 /etc/resolv.conf，延迟两秒再设置
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(2*time.Second, func() {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		if r.pending != timer {
+			return
+		}
+		r.pending = nil
+		// OpenWrt 会将 127.0.0.1 写在最下面，影响其上面的解析
+		err := utils.NewRecord(e.File).Write(b.String(), false)
+		if err != nil {
+			base.Error("set DNS failed")
+		}
+	})
+	r.pending = timer
+	return nil
+}
+
+func (r *fileResolver) Restore(cfg *dnsConfig) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.pending != nil {
+		r.pending.Stop()
+		r.pending = nil
+	}
+	e := r.entry()
+	err := undo(&e)
+	if err == nil {
+		journalRemove(e)
+	}
+	return err
+}
+
+// undoDNS 回滚 resolvconf 和 file 后端的日志
+func undoDNS(e *JournalEntry) error {
+	switch e.Backend {
+	case ResolverResolvconf:
+		path, err := exec.LookPath("resolvconf")
+		if err != nil {
+			return nil
+		}
+		out, err := exec.Command(path, "-d", e.Link).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s", err, out)
+		}
+		return nil
+	default:
+		if _, err := os.Stat(e.Backup); err != nil {
+			return nil
+		}
+		return utils.CopyFile(e.File, e.Backup)
+	}
+}
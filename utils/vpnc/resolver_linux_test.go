@@ -0,0 +1,181 @@
+package vpnc
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeResolved 记录 org.freedesktop.resolve1.Manager 收到的调用
+type fakeResolved struct {
+	mux     sync.Mutex
+	dns     map[int32][]resolvedAddress
+	domains map[int32][]resolvedDomain
+	route   map[int32]bool
+	reverts []int32
+}
+
+func (f *fakeResolved) SetLinkDNS(index int32, addrs []resolvedAddress) *dbus.Error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.dns[index] = addrs
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDomains(index int32, domains []resolvedDomain) *dbus.Error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.domains[index] = domains
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDefaultRoute(index int32, enable bool) *dbus.Error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.route[index] = enable
+	return nil
+}
+
+func (f *fakeResolved) RevertLink(index int32) *dbus.Error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.reverts = append(f.reverts, index)
+	delete(f.dns, index)
+	delete(f.domains, index)
+	return nil
+}
+
+// startBus 启动私有的 dbus-daemon 并导出 fakeResolved，systemBus 指向该总线
+func startBus(t *testing.T) *fakeResolved {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+	socket := filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--nopidfile", "--address=unix:path="+socket)
+	if err = cmd.Start(); err != nil {
+		t.Skip("start dbus-daemon:", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	dial := func() (*dbus.Conn, error) {
+		conn, err := dbus.Dial("unix:path=" + socket)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.Auth(nil); err == nil {
+			err = conn.Hello()
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	server, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	fake := &fakeResolved{
+		dns:     map[int32][]resolvedAddress{},
+		domains: map[int32][]resolvedDomain{},
+		route:   map[int32]bool{},
+	}
+	if err = server.Export(fake, resolvedPath, resolvedName+".Manager"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.RequestName(resolvedName, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	old := systemBus
+	systemBus = dial
+	t.Cleanup(func() { systemBus = old })
+	return fake
+}
+
+func TestResolvedResolver(t *testing.T) {
+	fake := startBus(t)
+	conn, ok := resolvedBus()
+	if !ok {
+		t.Fatal("systemd-resolved not found on the bus")
+	}
+	defer conn.Close()
+	r := &resolvedResolver{conn: conn}
+
+	tests := []struct {
+		name    string
+		cfg     dnsConfig
+		dns     []resolvedAddress
+		domains []resolvedDomain
+		route   bool
+	}{
+		{
+			name: "full tunnel",
+			cfg:  dnsConfig{Link: "utun", Index: 7, Servers: []string{"10.9.0.53", "fd00::53"}, Search: []string{"corp.example"}},
+			dns: []resolvedAddress{
+				{Family: 2, Address: net.ParseIP("10.9.0.53").To4()},
+				{Family: 10, Address: net.ParseIP("fd00::53").To16()},
+			},
+			domains: []resolvedDomain{{Domain: "corp.example"}, {Domain: ".", RoutingOnly: true}},
+			route:   true,
+		},
+		{
+			name: "split DNS",
+			cfg: dnsConfig{Link: "utun", Index: 8, Servers: []string{"10.9.0.53", "bad"}, Search: []string{"corp.example"},
+				Routing: []string{"corp.example", "lab.example"}},
+			dns:     []resolvedAddress{{Family: 2, Address: net.ParseIP("10.9.0.53").To4()}},
+			domains: []resolvedDomain{{Domain: "corp.example"}, {Domain: "lab.example", RoutingOnly: true}},
+			route:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := r.Set(&tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			index := int32(tt.cfg.Index)
+			fake.mux.Lock()
+			dns, domains, route := fake.dns[index], fake.domains[index], fake.route[index]
+			fake.mux.Unlock()
+			if !reflect.DeepEqual(dns, tt.dns) {
+				t.Errorf("SetLinkDNS = %v, want %v", dns, tt.dns)
+			}
+			if !reflect.DeepEqual(domains, tt.domains) {
+				t.Errorf("SetLinkDomains = %v, want %v", domains, tt.domains)
+			}
+			if route != tt.route {
+				t.Errorf("SetLinkDefaultRoute = %v, want %v", route, tt.route)
+			}
+
+			if err := r.Restore(&tt.cfg); err != nil {
+				t.Fatal(err)
+			}
+			fake.mux.Lock()
+			reverts := fake.reverts
+			_, left := fake.dns[index]
+			fake.mux.Unlock()
+			if len(reverts) == 0 || reverts[len(reverts)-1] != index || left {
+				t.Errorf("RevertLink = %v, want %d", reverts, index)
+			}
+		})
+	}
+}
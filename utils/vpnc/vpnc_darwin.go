@@ -23,6 +23,7 @@ func ConfigInterface(cSess *session.ConnSession) error {
 }
 
 func SetRoutes(cSess *session.ConnSession) error {
+	applyOverrides(cSess)
 	cmdStr1 := fmt.Sprintf("route add -host %s %s", cSess.ServerAddress, base.LocalInterface.Gateway)
 	err := execCmd([]string{cmdStr1})
 	if err != nil {
@@ -43,7 +44,7 @@ func SetRoutes(cSess *session.ConnSession) error {
 	if len(cSess.SplitExclude) > 0 {
 		for _, ipMask := range cSess.SplitExclude {
 			dst := utils.IpMaskToCIDR(ipMask)
-			cmdStr := fmt.Sprintf("route add -net %s %s", dst, base.LocalInterface.Gateway)
+			cmdStr := fmt.Sprintf("route add -net %s %s", dst, excludeGateway(cSess, ipMask))
 			err = execCmd([]string{cmdStr})
 			if err != nil {
 				return routingError(dst, err)
@@ -69,22 +70,13 @@ func ResetRoutes(cSess *session.ConnSession) {
 	if len(cSess.SplitExclude) > 0 {
 		for _, ipMask := range cSess.SplitExclude {
 			dst := utils.IpMaskToCIDR(ipMask)
-			cmdStr := fmt.Sprintf("route delete -net %s %s", dst, base.LocalInterface.Gateway)
+			cmdStr := fmt.Sprintf("route delete -net %s %s", dst, excludeGateway(cSess, ipMask))
 			_ = execCmd([]string{cmdStr})
 		}
 	}
 
 	if len(cSess.DynamicSplitExcludeDomains) > 0 {
-		cSess.DynamicSplitExcludeResolved.Range(func(_, value any) bool {
-			ips := value.([]string)
-			for _, ip := range ips {
-				dst := ip + "/32"
-				cmdStr := fmt.Sprintf("route delete -net %s %s", dst, base.LocalInterface.Gateway)
-				_ = execCmd([]string{cmdStr})
-			}
-
-			return true
-		})
+		DynamicDelExcludeRoutes(cSess.DynamicRoutes.IPs(session.RouteExclude))
 	}
 
 	if len(cSess.DNS) > 0 {
@@ -92,6 +84,14 @@ func ResetRoutes(cSess *session.ConnSession) {
 	}
 }
 
+// excludeGateway 直连网段直接指向物理网卡
+func excludeGateway(cSess *session.ConnSession, ipMask string) string {
+	if utils.InArray(cSess.LocalLAN, ipMask) {
+		return "-interface " + base.LocalInterface.Name
+	}
+	return base.LocalInterface.Gateway
+}
+
 func DynamicAddIncludeRoutes(ips []string) {
 	for _, ip := range ips {
 		dst := ip + "/32"
@@ -108,6 +108,22 @@ func DynamicAddExcludeRoutes(ips []string) {
 	}
 }
 
+func DynamicDelIncludeRoutes(ips []string) {
+	for _, ip := range ips {
+		dst := ip + "/32"
+		cmdStr := fmt.Sprintf("route delete -net %s %s", dst, VPNAddress)
+		_ = execCmd([]string{cmdStr})
+	}
+}
+
+func DynamicDelExcludeRoutes(ips []string) {
+	for _, ip := range ips {
+		dst := ip + "/32"
+		cmdStr := fmt.Sprintf("route delete -net %s %s", dst, base.LocalInterface.Gateway)
+		_ = execCmd([]string{cmdStr})
+	}
+}
+
 func GetLocalInterface() error {
 	localInterfaceIP, err := gateway.DiscoverInterface()
 	if err != nil {
@@ -174,12 +190,23 @@ func setDNS(cSess *session.ConnSession) error {
 		override = "d.add OverridePrimary # 1"
 	}
 
+	// 分离 DNS 时只有这些域名使用 VPN 的 DNS，为空则匹配所有域名
+	matchDomains := `""`
+	if len(cSess.SplitDNS) > 0 {
+		matchDomains = strings.Join(cSess.SplitDNS, " ")
+	}
+	var searchDomains string
+	if search := session.SplitDomains(cSess.DefaultDomain); len(search) > 0 {
+		searchDomains = "d.add SearchDomains * " + strings.Join(search, " ")
+	}
+
 	command := fmt.Sprintf(`
 		open
 		d.init
 		d.add ServerAddresses * %s
         d.add SearchOrder 1
-        d.add SupplementalMatchDomains * ""
+        d.add SupplementalMatchDomains * %s
+        %s
 		set State:/Network/Service/%s/DNS
 
 		d.init
@@ -189,7 +216,7 @@ func setDNS(cSess *session.ConnSession) error {
         %s
 		set State:/Network/Service/%s/IPv4
 		close
-	`, strings.Join(cSess.DNS, " "), cSess.TunName, cSess.VPNAddress, cSess.VPNAddress, cSess.TunName, override, cSess.TunName)
+	`, strings.Join(cSess.DNS, " "), matchDomains, searchDomains, cSess.TunName, cSess.VPNAddress, cSess.VPNAddress, cSess.TunName, override, cSess.TunName)
 
 	cmd := exec.Command("scutil")
 	cmd.Stdin = strings.NewReader(command)
@@ -1,13 +1,15 @@
 package vpnc
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"os/exec"
 	"strings"
-	"time"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 	"sslcon/base"
 	"sslcon/session"
 	"sslcon/utils"
@@ -35,35 +37,23 @@ func ConfigInterface(cSess *session.ConnSession) error {
 }
 
 func SetRoutes(cSess *session.ConnSession) error {
-	// routes
-	dst, _ := netlink.ParseIPNet(cSess.ServerAddress + "/32")
-	gateway := net.ParseIP(base.LocalInterface.Gateway)
-
-	ifaceIndex := iface.Attrs().Index
-	localInterfaceIndex := localInterface.Attrs().Index
-
-	route := netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst, Gw: gateway}
-	err := netlink.RouteAdd(&route)
-	if err != nil {
-		if !strings.HasSuffix(err.Error(), "exists") {
-			return routingError(dst, err)
-		}
-	}
-
+	applyOverrides(cSess)
 	// 如果包含路由为空必为全局路由，如果使用包含域名，则包含路由必须填写一个，如 dns 地址
 	if len(cSess.SplitInclude) == 0 {
 		cSess.SplitInclude = append(cSess.SplitInclude, "0.0.0.0/0.0.0.0")
+	}
+	policyRouting = base.Cfg.PolicyRouting
 
-		// 全局模式，重置默认路由优先级，如 OpenWrt 默认优先级为 0
-		zero, _ := netlink.ParseIPNet("0.0.0.0/0")
-		delAllRoute(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: zero})
-		_ = netlink.RouteAdd(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: zero, Gw: gateway, Priority: 10})
+	err := addBypassRoutes(cSess)
+	if err != nil {
+		return err
 	}
 
+	ifaceIndex := iface.Attrs().Index
 	// 如果使用域名包含，原则上不支持在顶级域名匹配中排除某个具体域名的 IP
 	for _, ipMask := range cSess.SplitInclude {
-		dst, _ = netlink.ParseIPNet(utils.IpMaskToCIDR(ipMask))
-		route = netlink.Route{LinkIndex: ifaceIndex, Dst: dst, Priority: 6}
+		dst, _ := netlink.ParseIPNet(utils.IpMaskToCIDR(ipMask))
+		route := netlink.Route{LinkIndex: ifaceIndex, Dst: dst, Priority: 6, Table: routeTable()}
 		err = netlink.RouteAdd(&route)
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "exists") {
@@ -72,17 +62,9 @@ func SetRoutes(cSess *session.ConnSession) error {
 		}
 	}
 
-	// 支持在 SplitInclude 网段中排除某个路由
-	if len(cSess.SplitExclude) > 0 {
-		for _, ipMask := range cSess.SplitExclude {
-			dst, _ = netlink.ParseIPNet(utils.IpMaskToCIDR(ipMask))
-			route = netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst, Gw: gateway, Priority: 5}
-			err = netlink.RouteAdd(&route)
-			if err != nil {
-				if !strings.HasSuffix(err.Error(), "exists") {
-					return routingError(dst, err)
-				}
-			}
+	if policyRouting {
+		if err = addRules(localInterface.Attrs().Name); err != nil {
+			return fmt.Errorf("policy routing: %w", err)
 		}
 	}
 
@@ -90,49 +72,232 @@ func SetRoutes(cSess *session.ConnSession) error {
 		setDNS(cSess)
 	}
 
+	if base.Cfg.KillSwitch {
+		if err = EnableKillSwitch(cSess); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func ResetRoutes(cSess *session.ConnSession) {
-	// routes
-	localInterfaceIndex := localInterface.Attrs().Index
+	if policyRouting {
+		delRules()
+	}
+	delBypassRoutes(cSess)
 
-	for _, ipMask := range cSess.SplitInclude {
-		if ipMask == "0.0.0.0/0.0.0.0" {
-			// 重置默认路由优先级
-			zero, _ := netlink.ParseIPNet("0.0.0.0/0")
-			gateway := net.ParseIP(base.LocalInterface.Gateway)
-			_ = netlink.RouteDel(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: zero})
-			_ = netlink.RouteAdd(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: zero, Gw: gateway})
-			break
+	if len(cSess.DNS) > 0 {
+		restoreDNS(cSess)
+	}
+}
+
+// addBypassRoutes 服务器地址、排除路由等不经过 VPN 的路由，指向物理网卡的网关，添加之前先写入日志
+func addBypassRoutes(cSess *session.ConnSession) error {
+	entries := bypassRoutes(cSess)
+	journalAdd(entries...)
+	for i := range entries {
+		if err := addRoute(&entries[i]); err != nil {
+			return err
 		}
 	}
 
-	dst, _ := netlink.ParseIPNet(cSess.ServerAddress + "/32")
-	_ = netlink.RouteDel(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst})
+	if len(cSess.DynamicSplitExcludeDomains) > 0 {
+		DynamicAddExcludeRoutes(cSess.DynamicRoutes.IPs(session.RouteExclude))
+	}
+	return nil
+}
 
-	if len(cSess.SplitExclude) > 0 {
-		for _, ipMask := range cSess.SplitExclude {
-			dst, _ = netlink.ParseIPNet(utils.IpMaskToCIDR(ipMask))
-			_ = netlink.RouteDel(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst})
+func delBypassRoutes(cSess *session.ConnSession) {
+	entries := bypassRoutes(cSess)
+	if len(cSess.DynamicSplitExcludeDomains) > 0 {
+		entries = append(entries, excludeRoutes(cSess.DynamicRoutes.IPs(session.RouteExclude))...)
+	}
+	for i := range entries {
+		delRoute(&entries[i])
+	}
+	journalRemove(entries...)
+}
+
+// bypassRoutes 不包括动态排除路由，VPN 网卡上的路由随网卡删除，无需记录
+func bypassRoutes(cSess *session.ConnSession) []JournalEntry {
+	link := localInterface.Attrs().Name
+	gateway := base.LocalInterface.Gateway
+	var entries []JournalEntry
+	// 策略路由模式下到服务端的连接通过 fwmark 绕过 VPN 路由表，不修改主路由表
+	if !policyRouting {
+		entries = append(entries, JournalEntry{Type: JournalRoute, Link: link, Dst: cSess.ServerAddress + "/32", Gw: gateway})
+		if fullTunnel(cSess) {
+			// 全局模式，重置默认路由优先级，如 OpenWrt 默认优先级为 0
+			entries = append(entries, JournalEntry{Type: JournalDefaultRoute, Link: link, Dst: "0.0.0.0/0", Gw: gateway, Priority: 10})
 		}
 	}
+	// 支持在 SplitInclude 网段中排除某个路由
+	for _, ipMask := range cSess.SplitExclude {
+		gw := gateway
+		// 直连网段不经过网关
+		if utils.InArray(cSess.LocalLAN, ipMask) {
+			gw = ""
+		}
+		entries = append(entries, JournalEntry{Type: JournalRoute, Link: link, Dst: utils.IpMaskToCIDR(ipMask), Gw: gw, Priority: 5, Table: routeTable()})
+	}
+	return entries
+}
 
-	if len(cSess.DynamicSplitExcludeDomains) > 0 {
-		cSess.DynamicSplitExcludeResolved.Range(func(_, value any) bool {
-			ips := value.([]string)
-			for _, ip := range ips {
-				dst, _ = netlink.ParseIPNet(ip + "/32")
-				_ = netlink.RouteDel(&netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst})
-			}
+func excludeRoutes(ips []string) []JournalEntry {
+	entries := make([]JournalEntry, 0, len(ips))
+	for _, ip := range ips {
+		entries = append(entries, JournalEntry{Type: JournalRoute, Link: localInterface.Attrs().Name, Dst: ip + "/32", Gw: base.LocalInterface.Gateway, Priority: 5, Table: routeTable()})
+	}
+	return entries
+}
 
-			return true
-		})
+func journalRoute(e *JournalEntry) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(e.Link)
+	if err != nil {
+		return nil, err
 	}
+	dst, err := netlink.ParseIPNet(e.Dst)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: net.ParseIP(e.Gw), Priority: e.Priority, Table: e.Table}
+	if route.Gw == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route, nil
+}
 
-	if len(cSess.DNS) > 0 {
-		restoreDNS(cSess)
+func addRoute(e *JournalEntry) error {
+	route, err := journalRoute(e)
+	if err != nil {
+		return err
 	}
+	if e.Type == JournalDefaultRoute {
+		delAllRoute(&netlink.Route{LinkIndex: route.LinkIndex, Dst: route.Dst})
+		_ = netlink.RouteAdd(route)
+		return nil
+	}
+	err = netlink.RouteAdd(route)
+	if err != nil && !strings.HasSuffix(err.Error(), "exists") {
+		return routingError(route.Dst, err)
+	}
+	return nil
+}
+
+func delRoute(e *JournalEntry) error {
+	route, err := journalRoute(e)
+	if err != nil {
+		return err
+	}
+	if e.Type == JournalDefaultRoute {
+		// 重置默认路由优先级
+		_ = netlink.RouteDel(&netlink.Route{LinkIndex: route.LinkIndex, Dst: route.Dst})
+		err = netlink.RouteAdd(&netlink.Route{LinkIndex: route.LinkIndex, Dst: route.Dst, Gw: route.Gw})
+		if errors.Is(err, unix.EEXIST) {
+			return nil
+		}
+		return err
+	}
+	// 指定优先级和范围，避免删除同一网段上内核添加的直连路由
+	return netlink.RouteDel(&netlink.Route{LinkIndex: route.LinkIndex, Dst: route.Dst, Priority: route.Priority, Scope: route.Scope, Table: route.Table})
+}
+
+// undo 回滚 Cleanup 中的一条日志
+func undo(e *JournalEntry) error {
+	switch e.Type {
+	case JournalRoute, JournalDefaultRoute:
+		err := delRoute(e)
+		if errors.Is(err, unix.ESRCH) {
+			return nil
+		}
+		var linkErr netlink.LinkNotFoundError
+		if errors.As(err, &linkErr) {
+			return nil
+		}
+		return err
+	case JournalDNS:
+		return undoDNS(e)
+	case JournalRule:
+		return delRule(e)
+	case JournalKillSwitch:
+		return delKillSwitch()
+	case JournalSysctl:
+		return os.WriteFile(e.File, []byte(e.Value), 0644)
+	case JournalPolicyMark:
+		return delMarkRestore()
+	}
+	return nil
+}
+
+func fullTunnel(cSess *session.ConnSession) bool {
+	return utils.InArray(cSess.SplitInclude, "0.0.0.0/0.0.0.0")
+}
+
+// RepointRoutes 默认网关变化但本机地址不变时，将绕过 VPN 的路由移到新的网关并更新 base.LocalInterface；
+// 本机地址变化时隧道已经失效，返回 true，由调用方重新建立隧道
+func RepointRoutes(cSess *session.ConnSession) (bool, error) {
+	route, err := defaultRoute()
+	if err != nil {
+		return false, err
+	}
+	src := route.Src
+	if src == nil {
+		if routes, err := netlink.RouteGet(route.Gw); err == nil && len(routes) > 0 {
+			src = routes[0].Src
+		}
+	}
+	if src.String() != base.LocalInterface.Ip4 {
+		base.Info("local address changed:", base.LocalInterface.Ip4, "->", src.String())
+		return true, nil
+	}
+	if route.LinkIndex == localInterface.Attrs().Index && route.Gw.String() == base.LocalInterface.Gateway {
+		return false, nil
+	}
+	link, err := netlink.LinkByIndex(route.LinkIndex)
+	if err != nil {
+		return false, err
+	}
+
+	base.Info("default gateway changed:", base.LocalInterface.Gateway, "->", route.Gw.String(), "dev", link.Attrs().Name)
+	delBypassRoutes(cSess)
+	localInterface = link
+	base.LocalInterface.Name = link.Attrs().Name
+	base.LocalInterface.Gateway = route.Gw.String()
+	base.LocalInterface.Mac = link.Attrs().HardwareAddr.String()
+	return false, addBypassRoutes(cSess)
+}
+
+// defaultRoute 物理网卡上优先级最高的默认路由，全局模式下 SetRoutes 重写的默认路由仅在没有其它默认路由时使用
+func defaultRoute() (*netlink.Route, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: unix.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	var best, rewritten *netlink.Route
+	for i := range routes {
+		r := &routes[i]
+		if r.Gw == nil || (r.Dst != nil && r.Dst.String() != "0.0.0.0/0") {
+			continue
+		}
+		if iface != nil && r.LinkIndex == iface.Attrs().Index {
+			continue
+		}
+		if localInterface != nil && r.LinkIndex == localInterface.Attrs().Index && r.Priority == 10 {
+			rewritten = r
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = r
+		}
+	}
+	if best == nil {
+		best = rewritten
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no default route")
+	}
+	return best, nil
 }
 
 func DynamicAddIncludeRoutes(ips []string) {
@@ -140,20 +305,36 @@ func DynamicAddIncludeRoutes(ips []string) {
 
 	for _, ip := range ips {
 		dst, _ := netlink.ParseIPNet(ip + "/32")
-		route := netlink.Route{LinkIndex: ifaceIndex, Dst: dst, Priority: 6}
+		route := netlink.Route{LinkIndex: ifaceIndex, Dst: dst, Priority: 6, Table: routeTable()}
 		_ = netlink.RouteAdd(&route)
 	}
 }
 
 func DynamicAddExcludeRoutes(ips []string) {
-	localInterfaceIndex := localInterface.Attrs().Index
-	gateway := net.ParseIP(base.LocalInterface.Gateway)
+	entries := excludeRoutes(ips)
+	journalAdd(entries...)
+	for i := range entries {
+		_ = addRoute(&entries[i])
+	}
+}
+
+// DynamicDelIncludeRoutes 删除过期的动态包含路由
+func DynamicDelIncludeRoutes(ips []string) {
+	ifaceIndex := iface.Attrs().Index
 
 	for _, ip := range ips {
 		dst, _ := netlink.ParseIPNet(ip + "/32")
-		route := netlink.Route{LinkIndex: localInterfaceIndex, Dst: dst, Gw: gateway, Priority: 5}
-		_ = netlink.RouteAdd(&route)
+		_ = netlink.RouteDel(&netlink.Route{LinkIndex: ifaceIndex, Dst: dst, Priority: 6, Table: routeTable()})
+	}
+}
+
+// DynamicDelExcludeRoutes 删除过期的动态排除路由
+func DynamicDelExcludeRoutes(ips []string) {
+	entries := excludeRoutes(ips)
+	for i := range entries {
+		_ = delRoute(&entries[i])
 	}
+	journalRemove(entries...)
 }
 
 func GetLocalInterface() error {
@@ -197,29 +378,48 @@ func setDNS(cSess *session.ConnSession) {
 			DynamicAddIncludeRoutes(cSess.DNS)
 		}
 
-		// 部分云服务器会在设置路由时重写 /etc/resolv.conf，延迟两秒再设置
-		go func() {
-			utils.CopyFile("/tmp/resolv.conf.bak", "/etc/resolv.conf")
-
-			var dnsString string
-			for _, dns := range cSess.DNS {
-				dnsString += fmt.Sprintf("nameserver %s\n", dns)
-			}
-			time.Sleep(2 * time.Second)
-			// OpenWrt 会将 127.0.0.1 写在最下面，影响其上面的解析
-			err := utils.NewRecord("/etc/resolv.conf").Write(dnsString, false)
-			if err != nil {
-				base.Error("set DNS failed")
-			}
-		}()
+		saveLocalDNS(true)
+		dnsResolver = detectResolver()
+		base.Info("DNS backend:", dnsResolver.Name())
+		err := dnsResolver.Set(newDNSConfig(cSess))
+		if err != nil {
+			base.Error("set DNS failed:", err)
+		}
 	}
 }
 
 func restoreDNS(cSess *session.ConnSession) {
 	// dns
-	// 软件崩溃会导致无法恢复 resolv.conf 从而无法上网，需要重启系统
-	if len(cSess.DNS) > 0 {
-		utils.CopyFile("/etc/resolv.conf", "/tmp/resolv.conf.bak")
+	// 软件崩溃时由 Cleanup 根据日志恢复
+	if len(cSess.DNS) > 0 && dnsResolver != nil {
+		err := dnsResolver.Restore(newDNSConfig(cSess))
+		if err != nil {
+			base.Error("restore DNS failed:", err)
+		}
+		saveLocalDNS(false)
+	}
+}
+
+func newDNSConfig(cSess *session.ConnSession) *dnsConfig {
+	// 所有查询交给转发器，由它按域名分流
+	if cSess.DNSForwarder != "" {
+		server := cSess.DNSForwarder
+		if cSess.DNSForwarderLink != "" {
+			server = cSess.DNSForwarderLink
+		}
+		return &dnsConfig{
+			Link:    cSess.TunName,
+			Index:   iface.Attrs().Index,
+			Servers: []string{server},
+			Search:  session.SplitDomains(cSess.DefaultDomain),
+		}
+	}
+	return &dnsConfig{
+		Link:    cSess.TunName,
+		Index:   iface.Attrs().Index,
+		Servers: cSess.DNS,
+		Search:  session.SplitDomains(cSess.DefaultDomain),
+		Routing: cSess.SplitDNS,
 	}
 }
 
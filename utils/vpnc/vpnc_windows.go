@@ -42,6 +42,7 @@ func ConfigInterface(cSess *session.ConnSession) error {
 }
 
 func SetRoutes(cSess *session.ConnSession) error {
+	applyOverrides(cSess)
 	// routes
 	dst, err := netip.ParsePrefix(cSess.ServerAddress + "/32")
 	nextHopGateway, _ = netip.ParseAddr(base.LocalInterface.Gateway)
@@ -69,7 +70,7 @@ func SetRoutes(cSess *session.ConnSession) error {
 	if len(cSess.SplitExclude) > 0 {
 		for _, ipMask := range cSess.SplitExclude {
 			dst, _ = netip.ParsePrefix(utils.IpMaskToCIDR(ipMask))
-			err = localInterface.AddRoute(dst, nextHopGateway, 5)
+			err = localInterface.AddRoute(dst, excludeNextHop(cSess, ipMask), 5)
 			if err != nil {
 				if !strings.HasSuffix(err.Error(), "exists.") {
 					return routingError(dst, err)
@@ -92,21 +93,21 @@ func ResetRoutes(cSess *session.ConnSession) {
 	if len(cSess.SplitExclude) > 0 {
 		for _, ipMask := range cSess.SplitExclude {
 			dst, _ = netip.ParsePrefix(utils.IpMaskToCIDR(ipMask))
-			localInterface.DeleteRoute(dst, nextHopGateway)
+			localInterface.DeleteRoute(dst, excludeNextHop(cSess, ipMask))
 		}
 	}
 
 	if len(cSess.DynamicSplitExcludeDomains) > 0 {
-		cSess.DynamicSplitExcludeResolved.Range(func(_, value any) bool {
-			ips := value.([]string)
-			for _, ip := range ips {
-				dst, _ = netip.ParsePrefix(ip + "/32")
-				localInterface.DeleteRoute(dst, nextHopGateway)
-			}
+		DynamicDelExcludeRoutes(cSess.DynamicRoutes.IPs(session.RouteExclude))
+	}
+}
 
-			return true
-		})
+// excludeNextHop 直连网段使用 0.0.0.0，即 on-link
+func excludeNextHop(cSess *session.ConnSession, ipMask string) netip.Addr {
+	if utils.InArray(cSess.LocalLAN, ipMask) {
+		return netip.IPv4Unspecified()
 	}
+	return nextHopGateway
 }
 
 func DynamicAddIncludeRoutes(ips []string) {
@@ -123,6 +124,20 @@ func DynamicAddExcludeRoutes(ips []string) {
 	}
 }
 
+func DynamicDelIncludeRoutes(ips []string) {
+	for _, ip := range ips {
+		dst, _ := netip.ParsePrefix(ip + "/32")
+		_ = iface.DeleteRoute(dst, nextHopVPN)
+	}
+}
+
+func DynamicDelExcludeRoutes(ips []string) {
+	for _, ip := range ips {
+		dst, _ := netip.ParsePrefix(ip + "/32")
+		_ = localInterface.DeleteRoute(dst, nextHopGateway)
+	}
+}
+
 func GetLocalInterface() error {
 	ifcs, err := winipcfg.GetAdaptersAddresses(windows.AF_INET, winipcfg.GAAFlagIncludeGateways)
 	if err != nil {
@@ -203,6 +218,7 @@ func setDNS(cSess *session.ConnSession) error {
 		servers = append(servers, addr)
 	}
 
-	err := iface.SetDNS(windows.AF_INET, servers, []string{})
+	// 分离 DNS 需要 NRPT，暂不支持，所有查询都使用 VPN 的 DNS
+	err := iface.SetDNS(windows.AF_INET, servers, session.SplitDomains(cSess.DefaultDomain))
 	return err
 }
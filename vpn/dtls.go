@@ -11,10 +11,11 @@ import (
 	"sslcon/base"
 	"sslcon/proto"
 	"sslcon/session"
+	"sslcon/utils/vpnc"
 )
 
-// 新建 dtls.Conn
-func dtlsChannel(cSess *session.ConnSession) {
+// 新建 dtls.Conn，ctx 取消会中断握手
+func dtlsChannel(ctx context.Context, cSess *session.ConnSession) {
 	var (
 		conn          *dtls.Conn
 		dSess         *session.DtlsSession
@@ -62,15 +63,26 @@ func dtlsChannel(cSess *session.ConnSession) {
 		// PSKIdentityHint: id,
 	}
 
-	conn, err = dtls.Dial("udp4", addr, config)
+	// 策略路由模式下需要在发送数据之前设置 fwmark
+	lc := net.ListenConfig{Control: vpnc.MarkControl}
+	pConn, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err == nil {
+		conn, err = dtls.Client(pConn, addr, config)
+		if err != nil {
+			_ = pConn.Close()
+		}
+	}
 	// https://github.com/pion/dtls/pull/649
 	if err != nil {
 		base.Error(err)
 		close(cSess.DtlsSetupChan) // 没有成功建立 DTLS 隧道
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
+	if base.Cfg.DTLSTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(base.Cfg.DTLSTimeout)*time.Second)
+		defer cancel()
+	}
 	if err = conn.HandshakeContext(ctx); err != nil {
 		base.Error(err)
 		close(cSess.DtlsSetupChan) // 没有成功建立 DTLS 隧道
@@ -112,7 +124,9 @@ func dtlsChannel(cSess *session.ConnSession) {
 		// base.Debug("dtls server to payloadIn")
 		// https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-02#section-2.3
 		// UDP 数据包的头部只有 1 字节
-		switch pl.Data[0] {
+		typ := pl.Data[0]
+		cSess.Stat.DTLS.Received(bytesReceived, typ)
+		switch typ {
 		case 0x07: // KEEPALIVE
 			// base.Debug("dtls receive KEEPALIVE")
 		case 0x05: // DISCONNECT
@@ -123,19 +137,26 @@ func dtlsChannel(cSess *session.ConnSession) {
 			pl.Type = 0x04
 			select {
 			case cSess.PayloadOutDTLS <- pl:
+				cSess.Stat.DTLS.Queue.Observe(len(cSess.PayloadOutDTLS))
 			case <-dSess.CloseChan:
+				cSess.Stat.DTLS.Queue.Drop()
 			}
 		case 0x04:
 			base.Debug("dtls receive DPD-RESP")
+			cSess.Stat.DTLS.DpdReceived()
 		case 0x00: // DATA
 			pl.Data = append(pl.Data[:0], pl.Data[1:bytesReceived]...)
 			select {
 			case cSess.PayloadIn <- pl:
+				cSess.Stat.PayloadIn.Observe(len(cSess.PayloadIn))
 			case <-dSess.CloseChan:
+				cSess.Stat.PayloadIn.Drop()
 				return
 			}
+		case 0x08: // COMPRESSED DATA
+			cSess.Stat.DTLS.Discard()
+			putPayloadBuffer(pl)
 		}
-		cSess.Stat.BytesReceived += uint64(bytesReceived)
 	}
 }
 
@@ -180,7 +201,7 @@ func payloadOutDTLSToServer(conn *dtls.Conn, dSess *session.DtlsSession, cSess *
 			base.Error("dtls payloadOut to server error:", err)
 			return
 		}
-		cSess.Stat.BytesSent += uint64(bytesSent)
+		cSess.Stat.DTLS.Sent(bytesSent)
 
 		// 释放由 tunToPayloadOut 申请的内存
 		putPayloadBuffer(pl)
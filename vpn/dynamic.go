@@ -0,0 +1,71 @@
+package vpn
+
+import (
+	"sync"
+	"time"
+
+	"sslcon/session"
+	"sslcon/utils"
+	"sslcon/utils/vpnc"
+)
+
+// dynamicExpireInterval 检查过期路由的间隔
+const dynamicExpireInterval = 30 * time.Second
+
+// dynamicRoutesMux 记录和增删路由需要一起完成，否则并发的更新和过期可能导致记录与路由不一致
+var dynamicRoutesMux sync.Mutex
+
+// updateDynamicRoutes 合并一次应答，已知的域名刷新 TTL，只为新地址添加路由
+func updateDynamicRoutes(cSess *session.ConnSession, route, domain string, answers map[string]uint32) {
+	if len(answers) == 0 {
+		return
+	}
+	dynamicRoutesMux.Lock()
+	defer dynamicRoutesMux.Unlock()
+	added, evicted := cSess.DynamicRoutes.Update(route, domain, answers)
+	if len(added) > 0 {
+		if route == session.RouteInclude {
+			vpnc.DynamicAddIncludeRoutes(added)
+		} else {
+			vpnc.DynamicAddExcludeRoutes(added)
+		}
+	}
+	delDynamicRoutes(cSess, evicted)
+}
+
+// expireDynamicRoutes 隧道关闭时退出，剩余的路由随网卡或者 ResetRoutes 删除
+func expireDynamicRoutes(cSess *session.ConnSession) {
+	ticker := time.NewTicker(dynamicExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cSess.CloseChan:
+			return
+		case now := <-ticker.C:
+			dynamicRoutesMux.Lock()
+			delDynamicRoutes(cSess, cSess.DynamicRoutes.Expire(now))
+			dynamicRoutesMux.Unlock()
+		}
+	}
+}
+
+func delDynamicRoutes(cSess *session.ConnSession, routes []session.DynamicRoute) {
+	var include, exclude []string
+	for _, r := range routes {
+		// DNS 和服务器地址的路由不属于动态路由
+		if utils.InArray(cSess.DNS, r.IP) || r.IP == cSess.ServerAddress {
+			continue
+		}
+		if r.Route == session.RouteInclude {
+			include = append(include, r.IP)
+		} else {
+			exclude = append(exclude, r.IP)
+		}
+	}
+	if len(include) > 0 {
+		vpnc.DynamicDelIncludeRoutes(include)
+	}
+	if len(exclude) > 0 {
+		vpnc.DynamicDelExcludeRoutes(exclude)
+	}
+}
@@ -0,0 +1,353 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"sslcon/base"
+	"sslcon/session"
+	"sslcon/utils/vpnc"
+)
+
+const forwarderTimeout = 5 * time.Second
+
+// forwarder 本地 DNS 转发器，按域名选择 VPN 或者本地的 DNS，返回应答之前先设置动态分流路由
+type forwarder struct {
+	cSess *session.ConnSession
+	vpn   []string // VPN 的 DNS
+	local []string // 物理网卡的 DNS，连接前获取
+	link  net.IP   // 同时监听的 VPN 网卡地址，只接受本机的查询
+	udp   []net.PacketConn
+	tcp   []net.Listener
+}
+
+var (
+	forwarderMux sync.Mutex
+	dnsForwarder *forwarder
+)
+
+// startForwarder 必须在设置 DNS 之前调用，成功后 cSess.DNSForwarder 为监听地址，setDNS 将系统 DNS 指向它
+func startForwarder(cSess *session.ConnSession) error {
+	if base.Cfg.DNSForwarder == "" || len(cSess.DNS) == 0 {
+		return nil
+	}
+	// 其它系统只有 127.0.0.1 可用，会与本机其它 DNS 服务冲突
+	if runtime.GOOS != "linux" {
+		return errors.New("dns forwarder is only supported on Linux")
+	}
+	if ip := net.ParseIP(base.Cfg.DNSForwarder); ip == nil || !ip.IsLoopback() {
+		return errors.New("dns forwarder must listen on a loopback address")
+	}
+	forwarderMux.Lock()
+	defer forwarderMux.Unlock()
+	// 重连时旧隧道的转发器可能尚未关闭
+	if dnsForwarder != nil {
+		dnsForwarder.close()
+		dnsForwarder = nil
+	}
+
+	addrs := []string{base.Cfg.DNSForwarder}
+	f := &forwarder{cSess: cSess, vpn: cSess.DNS}
+	// systemd-resolved 将查询绑定到 VPN 网卡发送，到达不了回环地址，改用 VPN 网卡地址
+	if vpnc.ResolvedRunning() {
+		f.link = net.ParseIP(cSess.VPNAddress)
+		addrs = append(addrs, cSess.VPNAddress)
+	}
+	servers, _ := vpnc.LocalDNS()
+	for _, s := range servers {
+		if s != base.Cfg.DNSForwarder {
+			f.local = append(f.local, s)
+		}
+	}
+	for _, addr := range addrs {
+		addr = net.JoinHostPort(addr, "53")
+		udp, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			f.close()
+			return err
+		}
+		f.udp = append(f.udp, udp)
+		tcp, err := net.Listen("tcp", addr)
+		if err != nil {
+			f.close()
+			return err
+		}
+		f.tcp = append(f.tcp, tcp)
+	}
+	dnsForwarder = f
+	cSess.DNSForwarder = base.Cfg.DNSForwarder
+	if f.link != nil {
+		cSess.DNSForwarderLink = cSess.VPNAddress
+	}
+	// 查询 VPN 的 DNS 必须经过隧道
+	vpnc.DynamicAddIncludeRoutes(cSess.DNS)
+
+	for i := range f.udp {
+		go f.serveUDP(f.udp[i])
+		go f.serveTCP(f.tcp[i])
+	}
+	go func() {
+		<-cSess.CloseChan
+		forwarderMux.Lock()
+		defer forwarderMux.Unlock()
+		if dnsForwarder == f {
+			f.close()
+			dnsForwarder = nil
+		}
+	}()
+	base.Info("dns forwarder:", addrs, "local upstream:", f.local)
+	return nil
+}
+
+func (f *forwarder) close() {
+	for _, udp := range f.udp {
+		_ = udp.Close()
+	}
+	for _, tcp := range f.tcp {
+		_ = tcp.Close()
+	}
+}
+
+// allowed 监听 VPN 网卡地址时，隧道另一端的主机也能访问，只接受本机发起的查询
+func (f *forwarder) allowed(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+	return ip.IsLoopback() || (f.link != nil && ip.Equal(f.link))
+}
+
+func (f *forwarder) serveUDP(udp net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !f.allowed(client) {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := f.handle(query, "udp"); resp != nil {
+				_, _ = udp.WriteTo(resp, client)
+			}
+		}()
+	}
+}
+
+func (f *forwarder) serveTCP(tcp net.Listener) {
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		if !f.allowed(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				_ = conn.SetDeadline(time.Now().Add(forwarderTimeout * 2))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := f.handle(query, "tcp")
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle 返回 nil 时客户端超时重试
+func (f *forwarder) handle(query []byte, network string) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+
+	cSess := f.cSess
+	include := matchDomains(cSess.DynamicSplitIncludeDomains, name)
+	exclude := !include && matchDomains(cSess.DynamicSplitExcludeDomains, name)
+	// 隧道只支持 IPv4，包含域名的 AAAA 记录会让客户端绕过隧道访问，直接返回空应答
+	if include && q.Type == dnsmessage.TypeAAAA {
+		return emptyAnswer(h, q)
+	}
+	upstreams, viaVPN := f.upstreams(name, exclude)
+
+	var resp []byte
+	for _, server := range upstreams {
+		resp, err = exchange(network, server, query, viaVPN)
+		if err == nil {
+			break
+		}
+		base.Debug("dns forwarder:", name, server, err)
+	}
+	if resp == nil {
+		return nil
+	}
+	if include || exclude {
+		f.addRoutes(name, resp, include)
+	}
+	if include {
+		resp = stripAAAA(resp)
+	}
+	return resp
+}
+
+// emptyAnswer NOERROR 且没有记录，客户端不会再尝试其它 DNS
+func emptyAnswer(h dnsmessage.Header, q dnsmessage.Question) []byte {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+	resp, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// stripAAAA 删除 ANY 等查询应答中的 AAAA 记录，没有时原样返回
+func stripAAAA(resp []byte) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return resp
+	}
+	answers := m.Answers[:0]
+	for _, rr := range m.Answers {
+		if rr.Header.Type != dnsmessage.TypeAAAA {
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == len(m.Answers) {
+		return resp
+	}
+	m.Answers = answers
+	packed, err := m.Pack()
+	if err != nil {
+		return resp
+	}
+	return packed
+}
+
+// upstreams 分离 DNS 时只有匹配的域名使用 VPN 的 DNS，否则全部使用 VPN 的 DNS，动态排除的域名总是使用本地 DNS
+func (f *forwarder) upstreams(name string, exclude bool) ([]string, bool) {
+	cSess := f.cSess
+	if len(f.local) == 0 {
+		return f.vpn, true
+	}
+	if exclude {
+		return f.local, false
+	}
+	if len(cSess.SplitDNS) == 0 ||
+		matchDomains(cSess.SplitDNS, name) ||
+		matchDomains(session.SplitDomains(cSess.DefaultDomain), name) ||
+		matchDomains(cSess.DynamicSplitIncludeDomains, name) {
+		return f.vpn, true
+	}
+	return f.local, false
+}
+
+// addRoutes 包括 CNAME 链上的所有 A 记录，隧道只支持 IPv4，忽略 AAAA
+func (f *forwarder) addRoutes(name string, resp []byte, include bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil {
+		return
+	}
+	answers := make(map[string]uint32)
+	for _, rr := range m.Answers {
+		if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+			answers[net.IP(a.A[:]).String()] = rr.Header.TTL
+		}
+	}
+	route := session.RouteExclude
+	if include {
+		route = session.RouteInclude
+	}
+	updateDynamicRoutes(f.cSess, route, name, answers)
+}
+
+func exchange(network, server string, query []byte, viaVPN bool) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: forwarderTimeout}
+	if !viaVPN {
+		// 全局模式下本地 DNS 也会经过隧道
+		dialer.Control = vpnc.BindControl
+	}
+	conn, err := dialer.Dial(network, net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(forwarderTimeout))
+	if network == "tcp" {
+		if err = writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// matchDomains 完全匹配或者子域名，忽略服务端下发的首尾的点和空白
+func matchDomains(domains []string, name string) bool {
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(strings.TrimSpace(d), "."))
+		if d != "" && (name == d || strings.HasSuffix(name, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
@@ -47,7 +47,9 @@ func tlsChannel(conn *tls.Conn, bufR *bufio.Reader, cSess *session.ConnSession,
 
 		// base.Debug("tls server to payloadIn", "Type", pl.Data[6])
 		// https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-03#section-2.2
-		switch pl.Data[6] {
+		typ := pl.Data[6]
+		cSess.Stat.TLS.Received(bytesReceived, typ)
+		switch typ {
 		case 0x00: // DATA
 			// base.Debug("tls receive DATA")
 			// 获取数据长度
@@ -59,20 +61,26 @@ func tlsChannel(conn *tls.Conn, bufR *bufio.Reader, cSess *session.ConnSession,
 
 			select {
 			case cSess.PayloadIn <- pl:
+				cSess.Stat.PayloadIn.Observe(len(cSess.PayloadIn))
 			case <-cSess.CloseChan:
+				cSess.Stat.PayloadIn.Drop()
 				return
 			}
 		case 0x04:
 			base.Debug("tls receive DPD-RESP")
+			cSess.Stat.TLS.DpdReceived()
 		case 0x03: // DPD-REQ
 			pl.Type = 0x04
 			select {
 			case cSess.PayloadOutTLS <- pl:
+				cSess.Stat.TLS.Queue.Observe(len(cSess.PayloadOutTLS))
 			case <-cSess.CloseChan:
 				return
 			}
+		case 0x08: // COMPRESSED DATA
+			cSess.Stat.TLS.Discard()
+			putPayloadBuffer(pl)
 		}
-		cSess.Stat.BytesReceived += uint64(bytesReceived)
 	}
 }
 
@@ -119,7 +127,7 @@ func payloadOutTLSToServer(conn *tls.Conn, cSess *session.ConnSession) {
 			base.Error("tls payloadOut to server error:", err)
 			return
 		}
-		cSess.Stat.BytesSent += uint64(bytesSent)
+		cSess.Stat.TLS.Sent(bytesSent)
 
 		// 释放由 tunToPayloadOut 申请的内存
 		putPayloadBuffer(pl)
@@ -87,12 +87,18 @@ func tunToPayloadOut(dev tun.Device, cSess *session.ConnSession) {
 		if cSess.DtlsConnected.Load() {
 			select {
 			case cSess.PayloadOutDTLS <- pl:
+				cSess.Stat.DTLS.Queue.Observe(len(cSess.PayloadOutDTLS))
 			case <-dSess.CloseChan:
+				// DTLS 中途关闭，丢弃该数据包，之后的数据包走 TLS
+				cSess.Stat.DTLS.Queue.Drop()
+				putPayloadBuffer(pl)
 			}
 		} else {
 			select {
 			case cSess.PayloadOutTLS <- pl:
+				cSess.Stat.TLS.Queue.Observe(len(cSess.PayloadOutTLS))
 			case <-cSess.CloseChan:
+				cSess.Stat.TLS.Queue.Drop()
 				return
 			}
 		}
@@ -126,8 +132,8 @@ func payloadInToTun(dev tun.Device, cSess *session.ConnSession) {
 			return
 		}
 
-		// 只有当使用域名分流且返回数据包为 DNS 时才进一步分析，少建几个协程
-		if cSess.DynamicSplitTunneling {
+		// 只有当使用域名分流且返回数据包为 DNS 时才进一步分析，少建几个协程，使用内置转发器时由转发器处理
+		if cSess.DynamicSplitTunneling && cSess.DNSForwarder == "" {
 			_, srcPort, _, _ := utils.ResolvePacket(pl.Data)
 			if srcPort == 53 {
 				go dynamicSplitRoutes(pl.Data, cSess)
@@ -164,43 +170,30 @@ func dynamicSplitRoutes(data []byte, cSess *session.ConnSession) {
 	dnsLayer := packet.Layer(layers.LayerTypeDNS)
 	if dnsLayer != nil {
 		dns, _ := dnsLayer.(*layers.DNS)
+		if len(dns.Questions) == 0 || dns.ANCount == 0 {
+			return
+		}
 
 		query := string(dns.Questions[0].Name)
 		// base.Debug("Query:", query)
 
+		// 分析流量后才知道请求的域名，即使已经设置路由，仍然需要分析流量以刷新 TTL 和地址，不可避免的 overhead
+		route := ""
 		if utils.InArrayGeneric(cSess.DynamicSplitIncludeDomains, query) {
-			// 分析流量后才知道请求的域名，即使已经设置路由，仍然需要分析流量，不可避免的 overhead
-			if _, ok := cSess.DynamicSplitIncludeResolved.Load(query); !ok && dns.ANCount > 0 {
-				var answers []string
-				for _, v := range dns.Answers {
-					// log.Printf("DNS Answer: %+v", v)
-					if v.Type == layers.DNSTypeA {
-						// fmt.Println("Name:", string(v.Name)) // cname, canonical name
-						// base.Debug("Address:", v.IP.String())
-						answers = append(answers, v.IP.String())
-					}
-				}
-				if len(answers) > 0 {
-					cSess.DynamicSplitIncludeResolved.Store(query, answers)
-					vpnc.DynamicAddIncludeRoutes(answers)
-				}
-			}
+			route = session.RouteInclude
 		} else if utils.InArrayGeneric(cSess.DynamicSplitExcludeDomains, query) {
-			if _, ok := cSess.DynamicSplitExcludeResolved.Load(query); !ok && dns.ANCount > 0 {
-				var answers []string
-				for _, v := range dns.Answers {
-					// log.Printf("DNS Answer: %+v", v)
-					if v.Type == layers.DNSTypeA {
-						// fmt.Println("Name:", string(v.Name)) // cname, canonical name
-						// base.Debug("Address:", v.IP.String())
-						answers = append(answers, v.IP.String())
-					}
-				}
-				if len(answers) > 0 {
-					cSess.DynamicSplitExcludeResolved.Store(query, answers)
-					vpnc.DynamicAddExcludeRoutes(answers)
-				}
+			route = session.RouteExclude
+		} else {
+			return
+		}
+		answers := make(map[string]uint32)
+		for _, v := range dns.Answers {
+			// log.Printf("DNS Answer: %+v", v)
+			if v.Type == layers.DNSTypeA {
+				// fmt.Println("Name:", string(v.Name)) // cname, canonical name
+				answers[v.IP.String()] = v.TTL
 			}
 		}
+		updateDynamicRoutes(cSess, route, query, answers)
 	}
 }
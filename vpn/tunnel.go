@@ -2,11 +2,12 @@ package vpn
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/hex"
-	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"sslcon/auth"
 	"sslcon/base"
@@ -46,8 +47,8 @@ func initTunnel() {
 	reqHeaders["X-DTLS12-CipherSuite"] = "ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:AES128-GCM-SHA256"
 }
 
-// SetupTunnel initiates an HTTP CONNECT command to establish a VPN
-func SetupTunnel() error {
+// SetupTunnel initiates an HTTP CONNECT command to establish a VPN, ctx only covers the negotiation
+func SetupTunnel(ctx context.Context) error {
 	initTunnel()
 
 	// https://github.com/golang/go/commit/da6c168378b4c1deb2a731356f1f438e4723b8a7
@@ -60,22 +61,26 @@ func SetupTunnel() error {
 	}
 
 	// 发送 CONNECT 请求
+	stop := utils.WatchConn(ctx, auth.Conn, time.Duration(base.Cfg.TunnelTimeout)*time.Second)
 	err := req.Write(auth.Conn)
 	if err != nil {
+		stop()
 		auth.Conn.Close()
-		return err
+		return utils.CtxErr(ctx, err)
 	}
 	var resp *http.Response
 	// resp.Body closed when tlsChannel exit
 	resp, err = http.ReadResponse(auth.BufR, req)
+	// 之后 tlsChannel 自行设置读超时
+	stop()
 	if err != nil {
 		auth.Conn.Close()
-		return err
+		return utils.CtxErr(ctx, err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		auth.Conn.Close()
-		return fmt.Errorf("tunnel negotiation failed %s", resp.Status)
+		return base.Errorf(base.ErrTunnelFailed, "tunnel negotiation failed %s", resp.Status)
 	}
 	// 协商成功，读取服务端返回的配置
 	// https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-03#section-2.1.3
@@ -94,19 +99,40 @@ func SetupTunnel() error {
 	cSess.ServerAddress = strings.Split(auth.Conn.RemoteAddr().String(), ":")[0]
 	cSess.Hostname = auth.Prof.Host
 	cSess.TLSCipherSuite = tls.CipherSuiteName(auth.Conn.ConnectionState().CipherSuite)
+	cSess.Overrides = base.Cfg.Overrides.Merge(auth.Prof.Overrides)
+	vpnc.ApplyDNSOverrides(cSess)
 
-	err = setupTun(cSess)
+	// 登录后 banner 必须在创建 tun 和设置路由之前确认
+	err = session.Sess.AcceptBanner(ctx, session.BannerPostLogin, cSess.Banner)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		auth.Conn.Close()
 		cSess.Close()
 		return err
 	}
+	err = setupTun(cSess)
+	if err != nil {
+		auth.Conn.Close()
+		cSess.Close()
+		return base.NewError(base.ErrTunCreateFailed, err)
+	}
+
+	// 转发器启动失败时仍然使用 VPN 的 DNS
+	if err = startForwarder(cSess); err != nil {
+		base.Error("dns forwarder:", err)
+	}
 
 	// 为了靠谱，不再异步设置，路由多的话可能要等等
 	err = vpnc.SetRoutes(cSess)
 	if err != nil {
 		auth.Conn.Close()
 		cSess.Close()
+		return base.NewError(base.ErrRoutingFailed, err)
+	}
+	if cSess.DynamicSplitTunneling {
+		go expireDynamicRoutes(cSess)
 	}
 	base.Info("tls channel negotiation succeeded")
 
@@ -116,7 +142,13 @@ func SetupTunnel() error {
 
 	if !base.Cfg.NoDTLS && cSess.DTLSPort != "" {
 		// https://datatracker.ietf.org/doc/html/draft-mavrogiannopoulos-openconnect-03#section-2.1.5
-		go dtlsChannel(cSess)
+		// DTLS 在后台握手，生命周期与 cSess 一致，不受 ctx 影响
+		dtlsCtx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-cSess.CloseChan
+			cancel()
+		}()
+		go dtlsChannel(dtlsCtx, cSess)
 	}
 
 	cSess.DPDTimer()
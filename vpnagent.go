@@ -20,6 +20,8 @@ func main() {
 		if service.Interactive() {
 			base.Setup()
 			rpc.Setup()
+			rpc.StartAlwaysOn()
+			rpc.StartTrustedNetworkDetection()
 			watchSignal() // 主协程退出则应用退出
 		} else {
 			svc.RunSvc()
@@ -51,6 +53,7 @@ func watchSignal() {
 		switch sig {
 		default:
 			base.Info("Stop")
+			rpc.StopAlwaysOn()
 			rpc.DisConnect()
 			return
 		}